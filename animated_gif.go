@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"math"
+	"os"
+
+	"github.com/disintegration/imaging"
+)
+
+// アニメーションGIFのデータか
+func isAnimatedGIF(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("GIF8")) && gifAnimated(bytes.NewReader(data))
+}
+
+// アニメーションGIFのファイルか（ヘッダーとブロックのみ読み込む）
+func isAnimatedGIFFile(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	header := make([]byte, 4)
+	if _, err := file.Read(header); err != nil || string(header) != "GIF8" {
+		return false
+	}
+	if _, err := file.Seek(0, 0); err != nil {
+		return false
+	}
+	return gifAnimated(file)
+}
+
+// アニメーションを維持したまま変換できるか
+// 見開きの分割・スライス・E-inkモード・形式の明示指定は先頭フレームの静止画として扱う
+// （余白トリミング・補正はアニメーションには適用しない）
+func keepsAnimation(opts imageOptions) bool {
+	return !opts.Eink && opts.Half == "" && opts.Slice < 0 &&
+		(opts.Format == "" || opts.Format == formatPolicyKeep)
+}
+
+// リサイズ後のサイズ（resizeAndConvertと同じく幅・高さ両方の指定は拡大しない）
+func animatedTargetSize(width, height int, opts imageOptions) (int, int) {
+	var scale float64
+	switch {
+	case opts.Width > 0 && opts.Height > 0:
+		if width <= opts.Width && height <= opts.Height {
+			return width, height
+		}
+		scale = math.Min(float64(opts.Width)/float64(width), float64(opts.Height)/float64(height))
+	case opts.Width > 0:
+		scale = float64(opts.Width) / float64(width)
+	case opts.Height > 0:
+		scale = float64(opts.Height) / float64(height)
+	default:
+		return width, height
+	}
+	return max(1, int(math.Round(float64(width)*scale))), max(1, int(math.Round(float64(height)*scale)))
+}
+
+// アニメーションGIFをフレームごとにリサイズ・回転（表示時間・破棄方法・ループ回数は維持）
+// フレームごとにctxを確認し、時間の上限を超えた場合は中断する
+func renderAnimatedGIF(ctx context.Context, data []byte, item string, opts imageOptions) (renderedImage, error) {
+	cfg, err := gif.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return renderedImage{}, fmt.Errorf("failed to decode image: %v", err)
+	}
+
+	// 画素数の上限は全フレームの合計で判定
+	if maxPixels := config.Limits.MaxMegapixels * 1000 * 1000; maxPixels > 0 {
+		frames := gifFrameCount(bytes.NewReader(data), 0)
+		if float64(cfg.Width)*float64(cfg.Height)*float64(frames) > maxPixels {
+			return renderedImage{}, newImageLimitError(fmt.Sprintf("%s (%dx%d, %d frames)", item, cfg.Width, cfg.Height, frames), errImageTooManyPixels)
+		}
+	}
+
+	// サイズの指定は回転後の向きに対して適用
+	rotated := rotatedConfig(image.Config{Width: cfg.Width, Height: cfg.Height}, opts.Rotate)
+	outWidth, outHeight := animatedTargetSize(rotated.Width, rotated.Height, opts)
+	if outWidth == rotated.Width && outHeight == rotated.Height && opts.Rotate == 0 {
+		return renderedImage{data: data, format: formatGIF}, nil
+	}
+	scaled := rotatedConfig(image.Config{Width: outWidth, Height: outHeight}, opts.Rotate)
+	width, height := scaled.Width, scaled.Height
+
+	anim, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return renderedImage{}, fmt.Errorf("failed to decode image: %v", err)
+	}
+
+	// 差分フレームは位置とサイズを同じ比率で縮小し、前のフレームとの重なりを保つ
+	scaleX := float64(width) / float64(cfg.Width)
+	scaleY := float64(height) / float64(cfg.Height)
+	for i, frame := range anim.Image {
+		if err := checkRenderContext(ctx, item); err != nil {
+			return renderedImage{}, err
+		}
+		bounds := frame.Bounds()
+		rect := image.Rect(
+			int(math.Round(float64(bounds.Min.X)*scaleX)), int(math.Round(float64(bounds.Min.Y)*scaleY)),
+			int(math.Round(float64(bounds.Max.X)*scaleX)), int(math.Round(float64(bounds.Max.Y)*scaleY)),
+		)
+		if rect.Dx() < 1 {
+			rect.Max.X = rect.Min.X + 1
+		}
+		if rect.Dy() < 1 {
+			rect.Max.Y = rect.Min.Y + 1
+		}
+		rect = rect.Intersect(image.Rect(0, 0, width, height))
+		if rect.Empty() {
+			rect = image.Rect(0, 0, 1, 1)
+		}
+
+		resized := imaging.Resize(frame, rect.Dx(), rect.Dy(), imaging.Lanczos)
+		if opts.Rotate != 0 {
+			resized = rotateImage(resized, opts.Rotate)
+			rect = rotateRect(rect, width, height, opts.Rotate)
+		}
+		anim.Image[i] = quantizeFrame(resized, frame.Palette, rect)
+	}
+	anim.Config.Width = outWidth
+	anim.Config.Height = outHeight
+
+	var encoded bytes.Buffer
+	if err := gif.EncodeAll(&encoded, anim); err != nil {
+		return renderedImage{}, err
+	}
+	return renderedImage{data: encoded.Bytes(), format: formatGIF}, nil
+}
+
+// リサイズしたフレームを元のパレットに戻す（半透明は閾値で透過色に）
+func quantizeFrame(img *image.NRGBA, palette color.Palette, rect image.Rectangle) *image.Paletted {
+	dst := image.NewPaletted(rect, palette)
+
+	transparent := -1
+	for i, c := range palette {
+		if _, _, _, a := c.RGBA(); a == 0 {
+			transparent = i
+			break
+		}
+	}
+
+	// 近い色の検索はRGB各5ビットの単位で結果を使い回す
+	var lookup [1 << 15]int16
+	for i := range lookup {
+		lookup[i] = -1
+	}
+
+	width, height := rect.Dx(), rect.Dy()
+	for y := 0; y < height; y++ {
+		src := img.Pix[y*img.Stride : y*img.Stride+width*4]
+		row := dst.Pix[y*dst.Stride : y*dst.Stride+width]
+		for x := range row {
+			r, g, b, a := src[x*4], src[x*4+1], src[x*4+2], src[x*4+3]
+			if a < 128 && transparent >= 0 {
+				row[x] = uint8(transparent)
+				continue
+			}
+			key := int(r>>3)<<10 | int(g>>3)<<5 | int(b>>3)
+			if lookup[key] < 0 {
+				lookup[key] = int16(palette.Index(color.NRGBA{R: r, G: g, B: b, A: 255}))
+			}
+			row[x] = uint8(lookup[key])
+		}
+	}
+	return dst
+}
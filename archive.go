@@ -0,0 +1,202 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nwaples/rardecode"
+)
+
+var (
+	errNotArchive    = errors.New("not an archive")
+	errNestedTooDeep = errors.New("nested archive depth limit exceeded")
+	errEntryTooLarge = errors.New("archive entry size limit exceeded")
+)
+
+// nestedArchiveCache 展開済みのネストしたアーカイブのキャッシュ
+var nestedArchiveCache *ImageCache
+
+// archiveRef アーカイブ参照（アーカイブ内のアーカイブを含む）
+type archiveRef struct {
+	DiskPath string   // ディスク上の最も外側のアーカイブ
+	Inner    []string // 外側から順に辿るアーカイブ内のアーカイブエントリ
+}
+
+// Key キャッシュキーやプリフェッチ状況に使う識別子
+func (r archiveRef) Key() string {
+	if len(r.Inner) == 0 {
+		return r.DiskPath
+	}
+	return r.DiskPath + "!" + strings.Join(r.Inner, "!")
+}
+
+// Ext 最も内側のアーカイブの拡張子
+func (r archiveRef) Ext() string {
+	if len(r.Inner) == 0 {
+		return strings.ToLower(filepath.Ext(r.DiskPath))
+	}
+	return strings.ToLower(filepath.Ext(r.Inner[len(r.Inner)-1]))
+}
+
+// parent ひとつ外側のアーカイブ参照
+func (r archiveRef) parent() archiveRef {
+	return archiveRef{DiskPath: r.DiskPath, Inner: r.Inner[:len(r.Inner)-1]}
+}
+
+// child アーカイブ内のアーカイブエントリへの参照
+func (r archiveRef) child(name string) archiveRef {
+	inner := make([]string, 0, len(r.Inner)+1)
+	inner = append(inner, r.Inner...)
+	return archiveRef{DiskPath: r.DiskPath, Inner: append(inner, name)}
+}
+
+// ネストしたアーカイブのキャッシュ初期化
+func initNestedArchiveCache() {
+	nestedArchiveCache = &ImageCache{
+		cache:   make(map[string]*CacheEntry),
+		maxSize: config.Archive.NestedCacheSize,
+		ttl:     time.Duration(config.Cache.TTLMinutes) * time.Minute,
+	}
+}
+
+// 相対パスをアーカイブ参照とアーカイブ内のエントリパスに分解
+// 例: "全集.zip/第1巻.cbz/001.jpg" -> {全集.zip, [第1巻.cbz]}, "001.jpg"
+func splitArchivePath(relPath string) (archiveRef, string, error) {
+	parts := strings.Split(strings.Trim(relPath, "/"), "/")
+
+	diskIndex := -1
+	for i := range parts {
+		candidate := filepath.Join(config.Manga.SourcePath, filepath.Join(parts[:i+1]...))
+		info, err := os.Stat(candidate)
+		if err != nil {
+			return archiveRef{}, "", err
+		}
+		if !info.IsDir() {
+			diskIndex = i
+			break
+		}
+	}
+
+	if diskIndex < 0 || !isArchiveFile(strings.ToLower(filepath.Ext(parts[diskIndex]))) {
+		return archiveRef{}, "", fmt.Errorf("%w: %s", errNotArchive, relPath)
+	}
+
+	ref := archiveRef{
+		DiskPath: filepath.Join(config.Manga.SourcePath, filepath.Join(parts[:diskIndex+1]...)),
+	}
+
+	// アーカイブ拡張子を持つセグメントごとに一段深いアーカイブとして扱う
+	var current []string
+	for _, part := range parts[diskIndex+1:] {
+		current = append(current, part)
+		if isArchiveFile(strings.ToLower(filepath.Ext(part))) {
+			ref.Inner = append(ref.Inner, strings.Join(current, "/"))
+			current = nil
+		}
+	}
+
+	if len(ref.Inner) > config.Archive.MaxNestedDepth {
+		return archiveRef{}, "", errNestedTooDeep
+	}
+
+	return ref, strings.Join(current, "/"), nil
+}
+
+// ネストしたアーカイブのデータを取得（キャッシュ優先）
+func loadNestedArchive(ref archiveRef) ([]byte, error) {
+	cacheKey := generateCacheKey(ref.Key(), "")
+	if data, found := nestedArchiveCache.Get(cacheKey); found {
+		return data, nil
+	}
+
+	maxSize := int64(config.Archive.MaxNestedSizeMB) * 1024 * 1024
+	data, err := extractEntryFromArchive(ref.parent(), ref.Inner[len(ref.Inner)-1], maxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	nestedArchiveCache.Set(cacheKey, data)
+	log.Printf("Loaded nested archive: %s (size: %d bytes)", ref.Key(), len(data))
+	return data, nil
+}
+
+// ZIPアーカイブを開く（ネストしたアーカイブはメモリ上で開く）
+func openZipArchive(ref archiveRef) (*zip.Reader, func(), error) {
+	if len(ref.Inner) == 0 {
+		reader, err := zip.OpenReader(ref.DiskPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		decodeZipNames(&reader.Reader, ref)
+		return &reader.Reader, func() { reader.Close() }, nil
+	}
+
+	data, err := loadNestedArchive(ref)
+	if err != nil {
+		return nil, nil, err
+	}
+	reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, nil, err
+	}
+	decodeZipNames(reader, ref)
+	return reader, func() {}, nil
+}
+
+// RARアーカイブを開く（ネストしたアーカイブはメモリ上で開く）
+func openRarArchive(ref archiveRef) (*rardecode.Reader, func(), error) {
+	if len(ref.Inner) == 0 {
+		// 分割RARは後続のボリュームを自動的に辿って読み込む
+		reader, err := rardecode.OpenReader(firstRarVolume(ref.DiskPath), archivePassword(ref))
+		if err != nil {
+			return nil, nil, classifyRarError(ref, err)
+		}
+		return &reader.Reader, func() { reader.Close() }, nil
+	}
+
+	data, err := loadNestedArchive(ref)
+	if err != nil {
+		return nil, nil, err
+	}
+	reader, err := rardecode.NewReader(bytes.NewReader(data), archivePassword(ref))
+	if err != nil {
+		return nil, nil, classifyRarError(ref, err)
+	}
+	return reader, func() {}, nil
+}
+
+// パスワード関連のエラーか判定
+func isPasswordError(err error) bool {
+	return errors.Is(err, errPasswordRequired) || errors.Is(err, errPasswordIncorrect)
+}
+
+// アーカイブ関連エラーをレスポンスに変換
+func respondArchiveError(c *gin.Context, err error) {
+	switch {
+	case os.IsNotExist(err):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Archive not found"})
+	case errors.Is(err, errNotArchive):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported archive format"})
+	case errors.Is(err, errNestedTooDeep):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "max_depth": config.Archive.MaxNestedDepth})
+	case errors.Is(err, errPasswordRequired):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error(), "code": "password_required"})
+	case errors.Is(err, errPasswordIncorrect):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error(), "code": "password_incorrect"})
+	case isImageLimitError(err):
+		respondImageError(c, err)
+	case errors.Is(err, errEntryTooLarge):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error(), "max_size_mb": config.Archive.MaxNestedSizeMB})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ArchiveFolder アーカイブ内のフォルダ（章）
+type ArchiveFolder struct {
+	Name      string           `json:"name"`
+	Path      string           `json:"path"`
+	PageCount int              `json:"page_count"`
+	FirstPage string           `json:"first_page,omitempty"`
+	Folders   []*ArchiveFolder `json:"folders,omitempty"`
+}
+
+// アーカイブ内のエントリをフォルダ階層に変換（ルートはアーカイブ自身）
+func buildArchiveTree(files []FileInfo) *ArchiveFolder {
+	root := &ArchiveFolder{}
+	folders := map[string]*ArchiveFolder{"": root}
+
+	// フォルダを取得（存在しない場合は親を辿って作成）
+	var folderFor func(dir string) *ArchiveFolder
+	folderFor = func(dir string) *ArchiveFolder {
+		if folder, exists := folders[dir]; exists {
+			return folder
+		}
+		parentDir := path.Dir(dir)
+		if parentDir == "." {
+			parentDir = ""
+		}
+		parent := folderFor(parentDir)
+		folder := &ArchiveFolder{Name: path.Base(dir), Path: dir}
+		parent.Folders = append(parent.Folders, folder)
+		folders[dir] = folder
+		return folder
+	}
+
+	pages := sortedArchivePages(files)
+	for _, page := range pages {
+		dir := path.Dir(page.Path)
+		if dir == "." {
+			dir = ""
+		}
+		folder := folderFor(dir)
+		if folder.FirstPage == "" {
+			folder.FirstPage = page.Path
+		}
+		folder.PageCount++
+	}
+
+	for _, folder := range folders {
+		sort.Slice(folder.Folders, func(i, j int) bool {
+			return folder.Folders[i].Path < folder.Folders[j].Path
+		})
+	}
+	return root
+}
+
+// アーカイブ内のページ（画像）をパス順に取得
+func sortedArchivePages(files []FileInfo) []FileInfo {
+	var pages []FileInfo
+	for _, file := range files {
+		if !file.IsArchive && !file.IsDir {
+			pages = append(pages, file)
+		}
+	}
+	sort.Slice(pages, func(i, j int) bool { return pages[i].Path < pages[j].Path })
+	return pages
+}
+
+// 指定フォルダ直下のフォルダとファイルを一覧（パスはフォルダからの相対パス）
+func listArchiveFolder(files []FileInfo, folder string) ([]FileInfo, bool) {
+	prefix := ""
+	if folder != "" {
+		prefix = strings.Trim(folder, "/") + "/"
+	}
+
+	var entries []FileInfo
+	subfolders := make(map[string]int)
+	found := prefix == ""
+
+	for _, file := range files {
+		if !strings.HasPrefix(file.Path, prefix) {
+			continue
+		}
+		found = true
+		rest := strings.TrimPrefix(file.Path, prefix)
+
+		// さらに下の階層にあるエントリはサブフォルダとしてまとめる
+		if i := strings.Index(rest, "/"); i >= 0 {
+			name := rest[:i]
+			if index, exists := subfolders[name]; exists {
+				entries[index].Size += file.Size
+				continue
+			}
+			subfolders[name] = len(entries)
+			entries = append(entries, FileInfo{
+				Name:  name,
+				Path:  name,
+				IsDir: true,
+				Size:  file.Size,
+			})
+			continue
+		}
+
+		file.Path = rest
+		entries = append(entries, file)
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	return entries, found
+}
+
+// アーカイブ内のフォルダまたは画像からサムネイル用の画像を抽出
+// 2番目の戻り値は抽出したページのパス（ライブラリからの相対パス）
+func extractImageForThumbnail(ref archiveRef, entry string) ([]byte, string, error) {
+	if entry == "" {
+		return extractFirstImageFromArchive(ref)
+	}
+	if isImageFile(strings.ToLower(filepath.Ext(entry))) {
+		data, err := extractImageFromArchive(ref, entry)
+		return data, archiveRelPath(ref) + "/" + entry, err
+	}
+
+	files, err := listArchiveFiles(ref)
+	if err != nil {
+		return nil, "", err
+	}
+	prefix := strings.Trim(entry, "/") + "/"
+	for _, page := range sortedArchivePages(files) {
+		if strings.HasPrefix(page.Path, prefix) {
+			data, err := extractImageFromArchive(ref, page.Path)
+			return data, archiveRelPath(ref) + "/" + page.Path, err
+		}
+	}
+	return nil, "", fmt.Errorf("no image found in folder: %s", entry)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// imageValidator 画像レスポンスの検証子（ETag・Last-Modified）
+type imageValidator struct {
+	etag    string
+	modTime time.Time
+}
+
+var settingsVersion string
+var settingsVersionOnce sync.Once
+
+// 設定の識別子（設定を変更すると変換結果が変わりうるためETagに含める）
+func imageSettingsVersion() string {
+	settingsVersionOnce.Do(func() {
+		settingsVersion = generateCacheKey("settings", fmt.Sprintf("%+v", config))
+	})
+	return settingsVersion
+}
+
+// 元画像の識別子（更新日時・サイズを含む）と変換パラメータから強いETagを生成
+// diskPathはLast-Modifiedに使うファイル（アーカイブ内の画像の場合はアーカイブ）
+func newImageValidator(key, diskPath string) imageValidator {
+	v := imageValidator{etag: `"` + generateCacheKey(imageSettingsVersion(), key) + `"`}
+	if info, err := os.Stat(diskPath); err == nil {
+		v.modTime = info.ModTime()
+	}
+	return v
+}
+
+// 条件付きリクエストに一致する場合は検証子のヘッダーとともに304を返す
+// 変換・展開の前に呼び出し、trueの場合はレスポンスを書き込まない
+// 一致しない場合は検証子を付けず、配信が成功した時点でserveImageContent・serveImageFileが設定する
+// （それまではno-storeとし、エラーのレスポンスがキャッシュ・再検証されないようにする）
+func respondNotModified(c *gin.Context, v imageValidator) bool {
+	if !notModified(c.Request, v) {
+		c.Header("Cache-Control", "no-store")
+		return false
+	}
+	setValidatorHeaders(c, v)
+	c.Status(http.StatusNotModified)
+	return true
+}
+
+// 検証子とキャッシュのヘッダー
+func setValidatorHeaders(c *gin.Context, v imageValidator) {
+	c.Header("ETag", v.etag)
+	if !v.modTime.IsZero() {
+		c.Header("Last-Modified", v.modTime.UTC().Format(http.TimeFormat))
+	}
+	c.Header("Cache-Control", "public, max-age=3600")
+}
+
+// If-None-Match（弱い比較）、指定がなければIf-Modified-Sinceで判定
+func notModified(r *http.Request, v imageValidator) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || tag == strings.TrimPrefix(v.etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" && !v.modTime.IsZero() {
+		since, err := http.ParseTime(ims)
+		return err == nil && !v.modTime.Truncate(time.Second).After(since)
+	}
+	return false
+}
+
+// 画像データを配信（Range・If-Rangeに対応）
+func serveImageContent(c *gin.Context, contentType string, data []byte, v imageValidator) {
+	setValidatorHeaders(c, v)
+	c.Header("Content-Type", contentType)
+	http.ServeContent(c.Writer, c.Request, "", v.modTime, bytes.NewReader(data))
+}
+
+// 画像ファイルをそのまま配信（Range・If-Rangeに対応）
+func serveImageFile(c *gin.Context, path string, v imageValidator) {
+	file, err := os.Open(path)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return
+	}
+	defer file.Close()
+
+	setValidatorHeaders(c, v)
+	http.ServeContent(c.Writer, c.Request, path, v.modTime, file)
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"github.com/gin-gonic/gin"
+)
+
+// ContactSheetTile コンタクトシート上のページの位置
+type ContactSheetTile struct {
+	Index  int    `json:"index"`
+	Path   string `json:"path"`
+	Sheet  int    `json:"sheet"`
+	X      int    `json:"x"`
+	Y      int    `json:"y"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// ContactSheetInfo コンタクトシート画像の情報
+type ContactSheetInfo struct {
+	Index  int    `json:"index"`
+	URL    string `json:"url"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Pages  int    `json:"pages"`
+}
+
+// 1枚のシートに並べるページ数
+func contactSheetPagesPerSheet() int {
+	return contactSheetColumns() * contactSheetRows()
+}
+
+func contactSheetColumns() int {
+	if config.ContactSheet.Columns > 0 {
+		return config.ContactSheet.Columns
+	}
+	return 10
+}
+
+func contactSheetRows() int {
+	if config.ContactSheet.Rows > 0 {
+		return config.ContactSheet.Rows
+	}
+	return 10
+}
+
+// コンタクトシートのレイアウトを返す
+func getContactSheet(c *gin.Context) {
+	src, ok := loadPageSource(c)
+	if !ok {
+		return
+	}
+
+	tileWidth, tileHeight := config.ContactSheet.TileWidth, config.ContactSheet.TileHeight
+	columns, perSheet := contactSheetColumns(), contactSheetPagesPerSheet()
+
+	tiles := make([]ContactSheetTile, 0, len(src.entries))
+	var sheets []ContactSheetInfo
+	for i, entry := range src.entries {
+		sheet, position := i/perSheet, i%perSheet
+		if position == 0 {
+			count := len(src.entries) - i
+			if count > perSheet {
+				count = perSheet
+			}
+			sheetColumns := columns
+			if count < columns {
+				sheetColumns = count
+			}
+			sheetRows := (count + columns - 1) / columns
+			sheets = append(sheets, ContactSheetInfo{
+				Index:  sheet,
+				URL:    "/api/v1/contact-sheet-image/" + url.QueryEscape(src.path) + "?sheet=" + strconv.Itoa(sheet),
+				Width:  sheetColumns * tileWidth,
+				Height: sheetRows * tileHeight,
+				Pages:  count,
+			})
+		}
+		tiles = append(tiles, ContactSheetTile{
+			Index:  i,
+			Path:   src.pagePath(entry),
+			Sheet:  sheet,
+			X:      (position % columns) * tileWidth,
+			Y:      (position / columns) * tileHeight,
+			Width:  tileWidth,
+			Height: tileHeight,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"path":        src.path,
+		"tile_width":  tileWidth,
+		"tile_height": tileHeight,
+		"columns":     columns,
+		"total_pages": len(tiles),
+		"sheets":      sheets,
+		"pages":       tiles,
+	})
+}
+
+// コンタクトシート画像を配信（未生成なら全シートをまとめて生成してキャッシュ）
+func serveContactSheetImage(c *gin.Context) {
+	src, ok := loadPageSource(c)
+	if !ok {
+		return
+	}
+
+	sheet, err := strconv.Atoi(c.DefaultQuery("sheet", "0"))
+	perSheet := contactSheetPagesPerSheet()
+	sheetCount := (len(src.entries) + perSheet - 1) / perSheet
+	if err != nil || sheet < 0 || sheet >= sheetCount {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Sheet not found", "sheets": sheetCount})
+		return
+	}
+
+	cacheKey := contactSheetCacheKey(src, sheet)
+	diskPath := src.dirPath
+	if src.isArchive {
+		diskPath = src.ref.DiskPath
+	}
+	validator := newImageValidator(cacheKey, diskPath)
+	if respondNotModified(c, validator) {
+		return
+	}
+
+	data, found := variantCache.Get(cacheKey)
+	if !found {
+		// 多数のページをデコードするため一括処理の優先度で、他の変換と同じ時間の上限付きで実行
+		c.Set(priorityContextKey, priorityBatch)
+		rendered, err := renderWithTimeout(c, src.path, func(ctx context.Context) (renderedImage, error) {
+			sheets, err := renderContactSheets(ctx, src)
+			if err != nil {
+				return renderedImage{}, err
+			}
+			if err := checkRenderContext(ctx, src.path); err != nil {
+				return renderedImage{}, err
+			}
+			for i, encoded := range sheets {
+				variantCache.Set(contactSheetCacheKey(src, i), encoded)
+			}
+			return renderedImage{data: sheets[sheet], format: formatJPEG}, nil
+		})
+		if err != nil {
+			log.Printf("Failed to render contact sheet: %v", err)
+			respondArchiveError(c, err)
+			return
+		}
+		data = rendered.data
+	}
+
+	setEncodedImageHeaders(c, formatJPEG, false)
+	serveImageContent(c, imageFormatContentType(formatJPEG), data, validator)
+}
+
+// シート画像のキャッシュキー（アーカイブ・ディレクトリの更新、ページの回転の変更で無効になる）
+func contactSheetCacheKey(src *pageSource, sheet int) string {
+	sourceKey := versionedCacheKey(src.dirPath, src.dirPath)
+	if src.isArchive {
+		sourceKey = archiveSourceKey(src.ref, "contact-sheet:"+src.folder)
+	}
+	var rotations strings.Builder
+	for _, entry := range src.entries {
+		if rotation := pageRotationStore.Get(src.pageKey(entry)); rotation != 0 {
+			fmt.Fprintf(&rotations, "%s=%d;", entry, rotation)
+		}
+	}
+	return generateCacheKey(sourceKey, fmt.Sprintf("contact-sheet:%dx%d:%dx%d:q=%d:sheet=%d:rotate=%s",
+		config.ContactSheet.TileWidth, config.ContactSheet.TileHeight, contactSheetColumns(), contactSheetRows(),
+		config.ContactSheet.Quality, sheet, rotations.String()))
+}
+
+// 全ページを縮小してシートに並べ、JPEGにエンコード
+// ctxが終了した場合（時間の上限・クライアントの切断）は残りのページをデコードせずに中断する
+func renderContactSheets(ctx context.Context, src *pageSource) ([][]byte, error) {
+	tileWidth, tileHeight := config.ContactSheet.TileWidth, config.ContactSheet.TileHeight
+	columns, perSheet := contactSheetColumns(), contactSheetPagesPerSheet()
+
+	positions := make(map[string]int, len(src.entries))
+	for i, entry := range src.entries {
+		positions[entry] = i
+	}
+
+	canvases := make([]*image.NRGBA, 0, (len(src.entries)+perSheet-1)/perSheet)
+	for start := 0; start < len(src.entries); start += perSheet {
+		count := len(src.entries) - start
+		if count > perSheet {
+			count = perSheet
+		}
+		sheetColumns := columns
+		if count < columns {
+			sheetColumns = count
+		}
+		sheetRows := (count + columns - 1) / columns
+		canvases = append(canvases, imaging.New(sheetColumns*tileWidth, sheetRows*tileHeight, color.NRGBA{34, 34, 34, 255}))
+	}
+
+	drawTile := func(entry string, data []byte) {
+		index, found := positions[entry]
+		if !found || ctx.Err() != nil {
+			return
+		}
+		img, err := decodeImage(data, src.pagePath(entry))
+		if err != nil {
+			log.Printf("Failed to decode page for contact sheet: %s: %v", entry, err)
+			return
+		}
+		if rotation := pageRotationStore.Get(src.pageKey(entry)); rotation != 0 {
+			img = rotateImage(img, rotation)
+		}
+		thumb := imaging.Fit(img, tileWidth, tileHeight, imaging.Linear)
+		position := index % perSheet
+		x := (position%columns)*tileWidth + (tileWidth-thumb.Bounds().Dx())/2
+		y := (position/columns)*tileHeight + (tileHeight-thumb.Bounds().Dy())/2
+		draw.Draw(canvases[index/perSheet], thumb.Bounds().Add(image.Pt(x, y)), thumb, image.Point{}, draw.Src)
+	}
+
+	if src.isArchive {
+		if err := forEachArchiveImage(src.ref, drawTile); err != nil {
+			return nil, err
+		}
+	} else {
+		for _, entry := range src.entries {
+			if ctx.Err() != nil {
+				break
+			}
+			data, err := readImageFile(filepath.Join(src.dirPath, entry))
+			if err != nil {
+				continue
+			}
+			drawTile(entry, data)
+		}
+	}
+
+	sheets := make([][]byte, len(canvases))
+	for i, canvas := range canvases {
+		if err := checkRenderContext(ctx, src.path); err != nil {
+			return nil, err
+		}
+		var encoded bytes.Buffer
+		if err := encodeImage(&encoded, canvas, formatJPEG, config.ContactSheet.Quality, false); err != nil {
+			return nil, err
+		}
+		sheets[i] = encoded.Bytes()
+	}
+	return sheets, nil
+}
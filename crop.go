@@ -0,0 +1,143 @@
+package main
+
+import (
+	"image"
+	"math"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"github.com/gin-gonic/gin"
+)
+
+// 余白トリミングのモード
+const (
+	cropModeAuto = "auto"
+	cropModeNone = "none"
+)
+
+const (
+	cropSampleWidth       = 800 // 余白検出に使う縮小画像の幅
+	cropMinContentPercent = 40  // トリミング後に残すべき最小サイズ（元画像比）
+	cropMaxPasses         = 4   // 余白検出の最大繰り返し回数
+)
+
+// 余白トリミングが有効か判定（crop= クエリ > ライブラリのcrop設定）
+func cropEnabled(c *gin.Context, relPath string) bool {
+	mode := strings.ToLower(c.Query("crop"))
+	if mode == "" {
+		mode = strings.ToLower(libraryFor(relPath).Crop)
+	}
+	return mode == cropModeAuto
+}
+
+// 上下左右の均一な余白を取り除く
+func autoCrop(img image.Image) image.Image {
+	content := detectContentBounds(img)
+	if content == img.Bounds() {
+		return img
+	}
+	return imaging.Crop(img, content)
+}
+
+// 余白を除いた内容部分の範囲を検出（検出できない場合は画像全体）
+func detectContentBounds(img image.Image) image.Rectangle {
+	bounds := img.Bounds()
+	if bounds.Dx() < 3 || bounds.Dy() < 3 {
+		return bounds
+	}
+
+	// 大きな画像は縮小して判定（縮小でスキャンノイズも平均化される）
+	sample := img
+	if bounds.Dx() > cropSampleWidth {
+		sample = imaging.Resize(img, cropSampleWidth, 0, imaging.Box)
+	}
+	gray := imaging.Grayscale(sample)
+	width, height := gray.Rect.Dx(), gray.Rect.Dy()
+	luminance := func(x, y int) int {
+		return int(gray.Pix[y*gray.Stride+x*4])
+	}
+
+	tolerance := config.Crop.Tolerance
+	noisePercent := config.Crop.NoisePercent
+
+	// 端のラインの平均色を基準に、許容範囲外の画素がノイズ比率以下なら余白とみなす
+	uniform := func(n int, at func(i int) int, reference int) bool {
+		limit := n * noisePercent / 100
+		deviations := 0
+		for i := 0; i < n; i++ {
+			diff := at(i) - reference
+			if diff > tolerance || diff < -tolerance {
+				deviations++
+				if deviations > limit {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	average := func(n int, at func(i int) int) int {
+		sum := 0
+		for i := 0; i < n; i++ {
+			sum += at(i)
+		}
+		return sum / n
+	}
+	// 行・列の画素（現在の範囲内のみ）
+	left, top, right, bottom := 0, 0, width, height
+	row := func(y int) func(i int) int { return func(i int) int { return luminance(left+i, y) } }
+	column := func(x int) func(i int) int { return func(i int) int { return luminance(x, top+i) } }
+
+	// 黒い縁の内側に白い余白がある場合に備え、変化がなくなるまで繰り返す
+	for pass := 0; pass < cropMaxPasses; pass++ {
+		previous := image.Rect(left, top, right, bottom)
+
+		columns := right - left
+		reference := average(columns, row(top))
+		for top < bottom && uniform(columns, row(top), reference) {
+			top++
+		}
+		reference = average(columns, row(bottom-1))
+		for bottom > top && uniform(columns, row(bottom-1), reference) {
+			bottom--
+		}
+		if bottom-top < 1 {
+			// 全面が均一（白紙ページ等）
+			return bounds
+		}
+
+		rows := bottom - top
+		reference = average(rows, column(left))
+		for left < right && uniform(rows, column(left), reference) {
+			left++
+		}
+		reference = average(rows, column(right-1))
+		for right > left && uniform(rows, column(right-1), reference) {
+			right--
+		}
+		if right-left < 1 {
+			return bounds
+		}
+
+		if image.Rect(left, top, right, bottom) == previous {
+			break
+		}
+	}
+
+	if (right-left)*100 < width*cropMinContentPercent || (bottom-top)*100 < height*cropMinContentPercent {
+		return bounds
+	}
+	if left == 0 && top == 0 && right == width && bottom == height {
+		return bounds
+	}
+
+	// 元画像の座標に戻す（内容を削らないよう外側に丸める）
+	scaleX := float64(bounds.Dx()) / float64(width)
+	scaleY := float64(bounds.Dy()) / float64(height)
+	content := image.Rect(
+		bounds.Min.X+int(math.Floor(float64(left)*scaleX)),
+		bounds.Min.Y+int(math.Floor(float64(top)*scaleY)),
+		bounds.Min.X+int(math.Ceil(float64(right)*scaleX)),
+		bounds.Min.Y+int(math.Ceil(float64(bottom)*scaleY)),
+	)
+	return content.Intersect(bounds)
+}
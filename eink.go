@@ -0,0 +1,79 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"github.com/gin-gonic/gin"
+)
+
+// 電子ペーパー向けレンダリングモード
+const renderModeEink = "eink"
+
+// E-inkモードが指定されているか
+func einkRequested(c *gin.Context) bool {
+	return strings.EqualFold(c.Query("mode"), renderModeEink)
+}
+
+// 階調数（levels= クエリ > einkのlevels、対応: 2, 4, 16, 256）
+func einkLevels(c *gin.Context) int {
+	levels, err := strconv.Atoi(c.Query("levels"))
+	if err != nil {
+		levels = config.Eink.Levels
+	}
+	switch levels {
+	case 2, 4, 16, 256:
+		return levels
+	}
+	return 16
+}
+
+// ディザリングの有無（dither= クエリ > einkのdither）
+func einkDither(c *gin.Context) bool {
+	if dither, err := strconv.ParseBool(c.Query("dither")); err == nil {
+		return dither
+	}
+	return config.Eink.Dither
+}
+
+// グレースケール化・コントラスト/ガンマ補正・減色を行う
+func renderEink(img image.Image, levels int, dither bool) image.Image {
+	// 透過部分は紙の色（白）として扱う
+	if hasTransparency(img) {
+		background := imaging.New(img.Bounds().Dx(), img.Bounds().Dy(), color.White)
+		img = imaging.Overlay(background, img, image.Pt(0, 0), 1.0)
+	}
+
+	adjusted := imaging.Grayscale(img)
+	if config.Eink.Contrast != 0 {
+		adjusted = imaging.AdjustContrast(adjusted, config.Eink.Contrast)
+	}
+	if config.Eink.Gamma > 0 && config.Eink.Gamma != 1 {
+		adjusted = imaging.AdjustGamma(adjusted, config.Eink.Gamma)
+	}
+
+	bounds := adjusted.Bounds()
+	if levels >= 256 {
+		gray := image.NewGray(bounds)
+		draw.Draw(gray, bounds, adjusted, bounds.Min, draw.Src)
+		return gray
+	}
+
+	// 階調数分のグレーパレットに減色（PNGは2/4ビット深度で保存される）
+	palette := make(color.Palette, levels)
+	for i := range palette {
+		value := uint8(i * 255 / (levels - 1))
+		palette[i] = color.Gray{Y: value}
+	}
+	paletted := image.NewPaletted(bounds, palette)
+	if dither {
+		draw.FloydSteinberg.Draw(paletted, bounds, adjusted, bounds.Min)
+	} else {
+		draw.Draw(paletted, bounds, adjusted, bounds.Min, draw.Src)
+	}
+	return paletted
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"archive/zip"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+// filenameEncoding ZIPファイル名の文字コード候補
+type filenameEncoding struct {
+	name     string
+	encoding encoding.Encoding
+}
+
+// 自動判定の候補（同点の場合は先頭を優先）
+var filenameEncodings = []filenameEncoding{
+	{"cp932", japanese.ShiftJIS},
+	{"euc-jp", japanese.EUCJP},
+	{"gbk", simplifiedchinese.GBK},
+}
+
+// 設定値から文字コードを取得（autoまたは空の場合はnil）
+func lookupFilenameEncoding(name string) (filenameEncoding, bool) {
+	switch strings.ToLower(strings.ReplaceAll(name, "_", "-")) {
+	case "cp932", "shift-jis", "sjis", "windows-31j":
+		return filenameEncodings[0], true
+	case "euc-jp", "eucjp":
+		return filenameEncodings[1], true
+	case "gbk", "gb2312", "cp936":
+		return filenameEncodings[2], true
+	}
+	return filenameEncoding{}, false
+}
+
+// ZIPエントリ名をUTF-8に変換（UTF-8フラグのない旧来のファイル名のみ）
+func decodeZipNames(reader *zip.Reader, ref archiveRef) {
+	var legacy []*zip.File
+	for _, file := range reader.File {
+		if file.Flags&0x800 == 0 && !utf8.ValidString(file.Name) {
+			legacy = append(legacy, file)
+		}
+	}
+	if len(legacy) == 0 {
+		return
+	}
+
+	setting := libraryFor(archiveRelPath(ref)).Encoding
+	if strings.EqualFold(setting, "utf-8") || strings.EqualFold(setting, "utf8") {
+		return
+	}
+
+	enc, ok := lookupFilenameEncoding(setting)
+	if !ok {
+		// アーカイブ内のファイル名全体から文字コードを判定（アーカイブ単位で統一）
+		names := make([]string, len(legacy))
+		for i, file := range legacy {
+			names[i] = file.Name
+		}
+		enc, ok = detectFilenameEncoding(names)
+		if !ok {
+			return
+		}
+	}
+
+	decoder := enc.encoding.NewDecoder()
+	for _, file := range legacy {
+		if decoded, err := decoder.String(file.Name); err == nil {
+			file.Name = decoded
+		}
+	}
+}
+
+// ファイル名として最も自然にデコードできる文字コードを判定
+func detectFilenameEncoding(names []string) (filenameEncoding, bool) {
+	joined := strings.Join(names, "\n")
+
+	best := filenameEncoding{}
+	bestScore := 0
+	found := false
+	for _, candidate := range filenameEncodings {
+		decoded, err := candidate.encoding.NewDecoder().String(joined)
+		if err != nil || strings.ContainsRune(decoded, utf8.RuneError) {
+			continue
+		}
+		score := filenameScore(decoded)
+		if !found || score > bestScore {
+			best = candidate
+			bestScore = score
+			found = true
+		}
+	}
+	return best, found
+}
+
+// デコード結果の自然さを評価（かな・漢字を加点、半角カナや記号類を減点）
+func filenameScore(s string) int {
+	score := 0
+	for _, r := range s {
+		switch {
+		case r >= 0x3040 && r <= 0x30FF: // ひらがな・カタカナ
+			score += 2
+		case r >= 0x4E00 && r <= 0x9FFF: // CJK統合漢字
+			score++
+		case r >= 0xFF61 && r <= 0xFF9F: // 半角カナ（誤判定で出やすい）
+			score -= 2
+		case r >= 0xE000 && r <= 0xF8FF: // 私用領域
+			score -= 3
+		}
+	}
+	return score
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"sort"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"github.com/gin-gonic/gin"
+)
+
+// 補正処理（enhance= クエリ、ライブラリのenhanceに指定）
+const (
+	enhanceLevels     = "levels"     // 黒・白の自動レベル補正
+	enhanceWhitePoint = "whitepoint" // 紙の黄ばみを白に補正
+	enhanceDesaturate = "desaturate" // 紙の色味を抜く
+	enhanceSharpen    = "sharpen"    // 軽いシャープ
+)
+
+// 補正処理の適用順
+var enhanceSteps = []string{enhanceWhitePoint, enhanceLevels, enhanceDesaturate, enhanceSharpen}
+
+// auto の場合に適用する補正
+var enhanceAutoSteps = []string{enhanceWhitePoint, enhanceLevels, enhanceSharpen}
+
+// 補正の指定（enhance= クエリ > ライブラリのenhance、auto またはカンマ区切り、none で無効）
+// 戻り値は適用順に並べたカンマ区切り（補正なしの場合は空）
+func enhanceMode(c *gin.Context, relPath string) string {
+	mode := strings.ToLower(strings.TrimSpace(c.Query("enhance")))
+	if mode == "" {
+		mode = strings.ToLower(strings.TrimSpace(libraryFor(relPath).Enhance))
+	}
+	return normalizeEnhance(mode)
+}
+
+func normalizeEnhance(mode string) string {
+	switch mode {
+	case "", "none", "off", "false":
+		return ""
+	case "auto", "true":
+		return strings.Join(enhanceAutoSteps, ",")
+	}
+
+	requested := make(map[string]bool)
+	for _, step := range strings.Split(mode, ",") {
+		requested[strings.TrimSpace(step)] = true
+	}
+	var steps []string
+	for _, step := range enhanceSteps {
+		if requested[step] {
+			steps = append(steps, step)
+		}
+	}
+	return strings.Join(steps, ",")
+}
+
+// 指定された補正を順に適用
+func enhanceImage(img image.Image, mode string) image.Image {
+	for _, step := range strings.Split(mode, ",") {
+		switch step {
+		case enhanceWhitePoint:
+			img = correctWhitePoint(img)
+		case enhanceLevels:
+			img = autoLevels(img)
+		case enhanceDesaturate:
+			img = desaturatePaper(img)
+		case enhanceSharpen:
+			if config.Enhance.Sharpen > 0 {
+				img = imaging.Sharpen(img, config.Enhance.Sharpen)
+			}
+		}
+	}
+	return img
+}
+
+// 輝度の一覧（縮小した画像から計算）
+func sampleLuminance(img image.Image) (*image.NRGBA, []int) {
+	sample := imaging.Resize(img, 400, 0, imaging.Box)
+	if sample.Bounds().Dy() > 400 {
+		sample = imaging.Resize(img, 0, 400, imaging.Box)
+	}
+	lums := make([]int, 0, len(sample.Pix)/4)
+	for i := 0; i+3 < len(sample.Pix); i += 4 {
+		lums = append(lums, luminance(sample.Pix[i], sample.Pix[i+1], sample.Pix[i+2]))
+	}
+	return sample, lums
+}
+
+func luminance(r, g, b uint8) int {
+	return (299*int(r) + 587*int(g) + 114*int(b)) / 1000
+}
+
+// 紙の色（明るい画素の平均）が白になるようにチャンネルごとに補正
+func correctWhitePoint(img image.Image) image.Image {
+	sample, lums := sampleLuminance(img)
+	if len(lums) == 0 {
+		return img
+	}
+	sorted := append([]int(nil), lums...)
+	sort.Ints(sorted)
+	threshold := sorted[len(sorted)*9/10]
+	if threshold < 96 {
+		// 暗い画像は紙の色を判定できない
+		return img
+	}
+
+	var sum [3]int
+	count := 0
+	for i, lum := range lums {
+		if lum >= threshold {
+			sum[0] += int(sample.Pix[i*4])
+			sum[1] += int(sample.Pix[i*4+1])
+			sum[2] += int(sample.Pix[i*4+2])
+			count++
+		}
+	}
+	var gain [3]float64
+	for ch := range gain {
+		paper := float64(sum[ch]) / float64(count)
+		if paper < 1 {
+			return img
+		}
+		gain[ch] = 255 / paper
+	}
+
+	return imaging.AdjustFunc(img, func(c color.NRGBA) color.NRGBA {
+		return color.NRGBA{
+			R: clampUint8(float64(c.R) * gain[0]),
+			G: clampUint8(float64(c.G) * gain[1]),
+			B: clampUint8(float64(c.B) * gain[2]),
+			A: c.A,
+		}
+	})
+}
+
+// 輝度の下位・上位の割合をそれぞれ黒・白に引き伸ばす
+func autoLevels(img image.Image) image.Image {
+	_, lums := sampleLuminance(img)
+	if len(lums) == 0 {
+		return img
+	}
+	sort.Ints(lums)
+	black := lums[int(float64(len(lums)-1)*config.Enhance.BlackPercent/100)]
+	white := lums[int(float64(len(lums)-1)*(1-config.Enhance.WhitePercent/100))]
+	if white-black < 32 {
+		// ほぼ単色の画像は補正しない
+		return img
+	}
+
+	scale := 255 / float64(white-black)
+	return imaging.AdjustFunc(img, func(c color.NRGBA) color.NRGBA {
+		return color.NRGBA{
+			R: clampUint8((float64(c.R) - float64(black)) * scale),
+			G: clampUint8((float64(c.G) - float64(black)) * scale),
+			B: clampUint8((float64(c.B) - float64(black)) * scale),
+			A: c.A,
+		}
+	})
+}
+
+// 明るい部分（紙）ほど彩度を落とす（カラーの絵柄は残す）
+func desaturatePaper(img image.Image) image.Image {
+	const start = 160 // これより明るい画素から彩度を落とし始める
+	return imaging.AdjustFunc(img, func(c color.NRGBA) color.NRGBA {
+		lum := luminance(c.R, c.G, c.B)
+		if lum <= start {
+			return c
+		}
+		weight := float64(lum-start) / float64(255-start)
+		gray := float64(lum)
+		return color.NRGBA{
+			R: clampUint8(float64(c.R) + (gray-float64(c.R))*weight),
+			G: clampUint8(float64(c.G) + (gray-float64(c.G))*weight),
+			B: clampUint8(float64(c.B) + (gray-float64(c.B))*weight),
+			A: c.A,
+		}
+	})
+}
+
+func clampUint8(value float64) uint8 {
+	if value <= 0 {
+		return 0
+	}
+	if value >= 255 {
+		return 255
+	}
+	return uint8(value + 0.5)
+}
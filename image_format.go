@@ -0,0 +1,283 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"github.com/gin-gonic/gin"
+)
+
+// 出力可能な画像形式
+const (
+	formatJPEG = "jpeg"
+	formatPNG  = "png"
+	formatGIF  = "gif" // アニメーションGIFのリサイズ結果のみ
+)
+
+// 出力形式の決定方針（ライブラリ単位のformat_policy）
+const (
+	formatPolicyKeep = "keep" // 元画像の形式を維持
+	formatPolicyPNG  = "png"  // 線画向けにロスレスPNG
+	formatPolicyJPEG = "jpeg" // 写真向けにJPEG
+)
+
+// imageOptions リサイズ・変換オプション
+type imageOptions struct {
+	Width       int
+	Height      int
+	Quality     int
+	Crop        bool   // 余白の自動トリミング
+	Half        string // 見開きの左右どちらを切り出すか（空の場合は全体）
+	Enhance     string // 適用する補正（適用順のカンマ区切り、空の場合は補正なし）
+	Rotate      int    // ページごとに保存された回転（時計回りの角度）
+	Slice       int    // 縦長ページのスライス番号（-1の場合は全体）
+	Eink        bool   // 電子ペーパー向けのグレースケール出力
+	Levels      int    // E-inkモードの階調数
+	Dither      bool   // E-inkモードのディザリング
+	Progressive bool   // JPEG出力をプログレッシブにする
+	Format      string // format= クエリで指定された形式（空の場合はネゴシエーション）
+	Policy      string // ライブラリの出力形式ポリシー
+	Accept      string // リクエストのAcceptヘッダー
+}
+
+// リクエストから変換オプションを生成（relPathはソースパスからの相対パス）
+func newImageOptions(c *gin.Context, relPath string, width, height, quality int) imageOptions {
+	return imageOptions{
+		Width:       width,
+		Height:      height,
+		Quality:     quality,
+		Crop:        cropEnabled(c, relPath),
+		Half:        normalizeHalf(c.Query("half")),
+		Enhance:     enhanceMode(c, relPath),
+		Rotate:      pageRotationStore.Get(relPath),
+		Slice:       stripSliceIndex(c),
+		Eink:        einkRequested(c),
+		Levels:      einkLevels(c),
+		Dither:      einkDither(c),
+		Progressive: progressiveRequested(c),
+		Format:      normalizeImageFormat(c.Query("format")),
+		Policy:      strings.ToLower(libraryFor(relPath).FormatPolicy),
+		Accept:      c.GetHeader("Accept"),
+	}
+}
+
+// progressive=true が指定されているか
+func progressiveRequested(c *gin.Context) bool {
+	progressive, _ := strconv.ParseBool(c.Query("progressive"))
+	return progressive
+}
+
+// 形式名を正規化（未対応の値は空）
+func normalizeImageFormat(format string) string {
+	switch strings.ToLower(format) {
+	case "jpeg", "jpg":
+		return formatJPEG
+	case "png":
+		return formatPNG
+	case "keep", "source", "original":
+		return formatPolicyKeep
+	}
+	return ""
+}
+
+// 画像データから形式を判定
+func detectImageFormat(data []byte) string {
+	contentType := http.DetectContentType(data)
+	return strings.TrimPrefix(contentType, "image/")
+}
+
+// 出力形式のContent-Type
+func imageFormatContentType(format string) string {
+	switch format {
+	case formatPNG:
+		return "image/png"
+	case formatGIF:
+		return "image/gif"
+	}
+	return "image/jpeg"
+}
+
+// 透過ピクセルを含む画像か判定
+func hasTransparency(img image.Image) bool {
+	if opaque, ok := img.(interface{ Opaque() bool }); ok {
+		return !opaque.Opaque()
+	}
+	return false
+}
+
+// 出力形式を決定（2番目の戻り値はAcceptヘッダーを参照したかどうか）
+func chooseOutputFormat(opts imageOptions, sourceFormat string, img image.Image) (string, bool) {
+	// クエリで明示された形式を最優先
+	requested := opts.Format
+	if requested == "" {
+		requested = opts.Policy
+	}
+	if requested == "" {
+		requested = formatPolicyKeep
+	}
+
+	preferred := requested
+	if requested == formatPolicyKeep {
+		switch sourceFormat {
+		case formatJPEG:
+			preferred = formatJPEG
+		case formatPNG:
+			preferred = formatPNG
+		default:
+			// エンコードできない形式（WebP・GIF等）は透過の有無で決定
+			preferred = formatJPEG
+			if hasTransparency(img) {
+				preferred = formatPNG
+			}
+		}
+	}
+
+	if opts.Format != "" && opts.Format != formatPolicyKeep {
+		return preferred, false
+	}
+
+	// クライアントが受け付けない場合は受け付ける形式に切り替え
+	if acceptQuality(opts.Accept, imageFormatContentType(preferred)) > 0 {
+		return preferred, true
+	}
+	alternative := formatJPEG
+	if preferred == formatJPEG {
+		alternative = formatPNG
+	}
+	if acceptQuality(opts.Accept, imageFormatContentType(alternative)) > 0 {
+		return alternative, true
+	}
+	return preferred, true
+}
+
+// 透過の有無で出力形式が変わるかの判定用（1画素の透明な画像）
+var transparentPixel = image.NewNRGBA(image.Rect(0, 0, 1, 1))
+
+// 変換結果の出力形式（デコード前に決定できる範囲で、キャッシュキーに使用）
+// 透過の有無で形式が変わる場合は、透過あり・なしそれぞれの形式を返す
+func variantOutputFormat(opts imageOptions, imageData []byte) string {
+	if opts.Eink {
+		return formatPNG
+	}
+	sourceFormat := detectImageFormat(imageData)
+	opaque, _ := chooseOutputFormat(opts, sourceFormat, nil)
+	transparent, _ := chooseOutputFormat(opts, sourceFormat, transparentPixel)
+	if opaque == transparent {
+		return opaque
+	}
+	return opaque + "|" + transparent
+}
+
+// AcceptヘッダーにおけるMIMEタイプのq値（ヘッダーがない場合は1）
+func acceptQuality(accept, mimeType string) float64 {
+	if strings.TrimSpace(accept) == "" {
+		return 1
+	}
+
+	best := -1.0
+	specificity := -1
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		mediaRange := strings.ToLower(strings.TrimSpace(fields[0]))
+
+		level := -1
+		switch {
+		case mediaRange == mimeType:
+			level = 2
+		case mediaRange == "image/*" && strings.HasPrefix(mimeType, "image/"):
+			level = 1
+		case mediaRange == "*/*":
+			level = 0
+		}
+		if level < specificity || level < 0 {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if value, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64); err == nil {
+					q = value
+				}
+			}
+		}
+		// より具体的な指定を優先
+		if level > specificity || q > best {
+			best = q
+			specificity = level
+		}
+	}
+	if best < 0 {
+		return 0
+	}
+	return best
+}
+
+// 変換済み画像のレスポンスヘッダー
+func setEncodedImageHeaders(c *gin.Context, format string, vary bool) {
+	c.Header("Content-Type", imageFormatContentType(format))
+	c.Header("Cache-Control", "public, max-age=3600")
+	if vary {
+		c.Writer.Header().Add("Vary", "Accept")
+	}
+}
+
+// 出力形式がAcceptヘッダーで決まりうるか（キャッシュ済み・304の応答でVaryを付けるため）
+func acceptMayVary(opts imageOptions) bool {
+	return !opts.Eink && (opts.Format == "" || opts.Format == formatPolicyKeep)
+}
+
+// 指定形式でエンコード（progressiveはJPEGの場合のみ有効）
+func encodeImage(w io.Writer, img image.Image, format string, quality int, progressive bool) error {
+	if format == formatPNG {
+		// グレースケール・減色済みの画像は小さいため最大圧縮
+		switch img.(type) {
+		case *image.Gray, *image.Paletted:
+			return imaging.Encode(w, img, imaging.PNG, imaging.PNGCompressionLevel(png.BestCompression))
+		}
+		return imaging.Encode(w, img, imaging.PNG)
+	}
+
+	// JPEGは透過を扱えないため白背景に合成
+	if hasTransparency(img) {
+		background := imaging.New(img.Bounds().Dx(), img.Bounds().Dy(), color.White)
+		img = imaging.Overlay(background, img, image.Pt(0, 0), 1.0)
+	}
+	if progressive {
+		return encodeProgressiveJPEG(w, img, quality)
+	}
+	return imaging.Encode(w, img, imaging.JPEG, imaging.JPEGQuality(quality))
+}
+
+// リサイズと出力形式の決定（E-inkモードの変換を含む）
+func resizeAndConvert(img image.Image, imageData []byte, opts imageOptions) (image.Image, string, bool) {
+	if opts.Width > 0 && opts.Height > 0 {
+		img = imaging.Fit(img, opts.Width, opts.Height, imaging.Lanczos)
+	} else if opts.Width > 0 {
+		img = imaging.Resize(img, opts.Width, 0, imaging.Lanczos)
+	} else if opts.Height > 0 {
+		img = imaging.Resize(img, 0, opts.Height, imaging.Lanczos)
+	}
+
+	// スキャンの補正（縮小後に行うためシャープは表示サイズで効く）
+	if opts.Enhance != "" {
+		img = enhanceImage(img, opts.Enhance)
+	}
+
+	// 出力形式を決定（format= クエリ > ライブラリのポリシー > Acceptヘッダー）
+	format, vary := chooseOutputFormat(opts, detectImageFormat(imageData), img)
+
+	// E-inkモードはグレースケールに変換してPNGで配信
+	if opts.Eink {
+		img = renderEink(img, opts.Levels, opts.Dither)
+		format, vary = formatPNG, false
+	}
+	return img, format, vary
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// JSONStore ライブラリ内のパスごとの値（見開きオフセット・ページ回転など）をJSONファイルに永続化するストア
+// ファイル名が空の場合はメモリ上にのみ保持
+type JSONStore[V comparable] struct {
+	values   map[string]V
+	filename string
+	version  uint64 // 変更のたびに増える値（保存内容から生成したキャッシュの無効化に使用）
+	mutex    sync.RWMutex
+}
+
+func newJSONStore[V comparable](filename string) *JSONStore[V] {
+	return &JSONStore[V]{
+		values:   make(map[string]V),
+		filename: filename,
+	}
+}
+
+// ライブラリからの相対パスを正規化（区切り文字を/に統一し、前後の/を除く）
+func normalizeLibraryPath(path string) string {
+	return strings.Trim(filepath.ToSlash(path), "/")
+}
+
+// Get パスの値を取得（未保存の場合はゼロ値）
+func (js *JSONStore[V]) Get(path string) V {
+	js.mutex.RLock()
+	defer js.mutex.RUnlock()
+	return js.values[normalizeLibraryPath(path)]
+}
+
+// Set パスの値を保存（ゼロ値の場合は削除）
+func (js *JSONStore[V]) Set(path string, value V) error {
+	js.mutex.Lock()
+	defer js.mutex.Unlock()
+
+	path = normalizeLibraryPath(path)
+	var zero V
+	if value == zero {
+		delete(js.values, path)
+	} else {
+		js.values[path] = value
+	}
+	js.version++
+	return js.save()
+}
+
+// Version 変更回数（起動後に値が変更されるたびに増える）
+func (js *JSONStore[V]) Version() uint64 {
+	js.mutex.RLock()
+	defer js.mutex.RUnlock()
+	return js.version
+}
+
+// Len 保存している件数
+func (js *JSONStore[V]) Len() int {
+	js.mutex.RLock()
+	defer js.mutex.RUnlock()
+	return len(js.values)
+}
+
+func (js *JSONStore[V]) load() error {
+	if js.filename == "" {
+		return nil
+	}
+	data, err := os.ReadFile(js.filename)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &js.values)
+}
+
+func (js *JSONStore[V]) save() error {
+	if js.filename == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(js.values, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(js.filename, data, 0644)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// LibraryConfig ライブラリ（ディレクトリ）単位の設定
+type LibraryConfig struct {
+	Path         string `yaml:"path"`
+	Encoding     string `yaml:"encoding"`      // ZIPファイル名の文字コード（auto, cp932, euc-jp, gbk, utf-8）
+	FormatPolicy string `yaml:"format_policy"` // リサイズ時の出力形式（keep, png, jpeg）
+	Crop         string `yaml:"crop"`          // 余白トリミングの既定値（auto, none）
+	Enhance      string `yaml:"enhance"`       // 補正の既定値（auto, none, levels,whitepoint,desaturate,sharpen）
+	Direction    string `yaml:"direction"`     // 読み方向（rtl: 右綴じ, ltr: 左綴じ）
+}
+
+// ソースパスからの相対パスに最も長く一致するライブラリ設定を取得
+func libraryFor(relPath string) LibraryConfig {
+	relPath = strings.Trim(filepath.ToSlash(relPath), "/")
+
+	best := LibraryConfig{}
+	bestLen := -1
+	for _, library := range config.Libraries {
+		path := strings.Trim(filepath.ToSlash(library.Path), "/")
+		if path == "" || path == relPath || strings.HasPrefix(relPath, path+"/") {
+			if len(path) > bestLen {
+				best = library
+				bestLen = len(path)
+			}
+		}
+	}
+	return best
+}
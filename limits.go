@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/gin-gonic/gin"
+)
+
+// 信頼できない画像に対する制限
+var (
+	errImageTooLarge      = errors.New("image file size limit exceeded")
+	errImageTooManyPixels = errors.New("image pixel limit exceeded")
+	errImageTimeout       = errors.New("image processing time limit exceeded")
+)
+
+// imageLimitError 制限を超えた画像とその理由
+type imageLimitError struct {
+	Item string
+	Err  error
+}
+
+func (e *imageLimitError) Error() string {
+	return fmt.Sprintf("%v: %s", e.Err, e.Item)
+}
+
+func (e *imageLimitError) Unwrap() error {
+	return e.Err
+}
+
+// 制限超過のエラーを生成（対象をログに残す）
+func newImageLimitError(item string, err error) error {
+	log.Printf("Image limit exceeded: %s (%v)", item, err)
+	return &imageLimitError{Item: item, Err: err}
+}
+
+// 画像ファイル・アーカイブエントリの最大サイズ（バイト、0の場合は無制限）
+func maxImageBytes() int64 {
+	return int64(config.Limits.MaxImageSizeMB) * 1024 * 1024
+}
+
+// 画像ファイルを読み込む（サイズの上限を超える場合は読み込まない）
+func readImageFile(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if limit := maxImageBytes(); limit > 0 && info.Size() > limit {
+		return nil, newImageLimitError(path, errImageTooLarge)
+	}
+	return os.ReadFile(path)
+}
+
+// ヘッダーの画素数を確認してからデコード（EXIFの向きを反映）
+func decodeImage(data []byte, item string) (image.Image, error) {
+	if maxPixels := config.Limits.MaxMegapixels * 1000 * 1000; maxPixels > 0 {
+		cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode image: %v", err)
+		}
+		if float64(cfg.Width)*float64(cfg.Height) > maxPixels {
+			return nil, newImageLimitError(fmt.Sprintf("%s (%dx%d)", item, cfg.Width, cfg.Height), errImageTooManyPixels)
+		}
+	}
+
+	img, err := imaging.Decode(bytes.NewReader(data), imaging.AutoOrientation(true))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %v", err)
+	}
+	return img, nil
+}
+
+// 変換結果
+type renderedImage struct {
+	data   []byte
+	format string
+	vary   bool
+	slices int // 縦長ページのスライス数（スライスを要求した場合のみ）
+}
+
+// 優先度順に実行枠を確保し、時間の上限付きで変換処理を実行
+// 上限を超えた場合・クライアントが切断した場合は結果を待たずに返す
+// 処理側はctxをcheckRenderContextで段階ごとに確認して中断し、実行枠を解放する
+func renderWithTimeout(c *gin.Context, item string, render func(ctx context.Context) (renderedImage, error)) (renderedImage, error) {
+	ctx := c.Request.Context()
+	if timeout := time.Duration(config.Limits.ProcessingTimeoutSeconds) * time.Second; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	// 実行枠を待つ時間も上限に含める
+	if err := imageScheduler.Acquire(ctx, imagePriority(c)); err != nil {
+		return renderedImage{}, checkRenderContext(ctx, item)
+	}
+
+	type result struct {
+		rendered renderedImage
+		err      error
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer imageScheduler.Release()
+		rendered, err := render(ctx)
+		done <- result{rendered, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.rendered, r.err
+	case <-ctx.Done():
+		return renderedImage{}, checkRenderContext(ctx, item)
+	}
+}
+
+// 処理を続けられるか確認（上限を超えた場合は制限超過、切断された場合はその理由のエラー）
+// デコード・リサイズ・エンコードなどの段階の間、キャッシュへの保存の前に呼び出す
+func checkRenderContext(ctx context.Context, item string) error {
+	switch err := ctx.Err(); {
+	case err == nil:
+		return nil
+	case errors.Is(err, context.DeadlineExceeded):
+		return newImageLimitError(item, errImageTimeout)
+	default:
+		return err
+	}
+}
+
+// 画像処理のエラーを返す（制限超過は理由ごとに区別する）
+func respondImageError(c *gin.Context, err error) {
+	// エラーはキャッシュさせない（検証子も付けない）
+	c.Header("Cache-Control", "no-store")
+	c.Header("ETag", "")
+	c.Header("Last-Modified", "")
+
+	var limitErr *imageLimitError
+	if !errors.As(err, &limitErr) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	switch {
+	case errors.Is(err, errImageTooLarge):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": limitErr.Err.Error(), "code": "image_too_large",
+			"item": limitErr.Item, "max_size_mb": config.Limits.MaxImageSizeMB})
+	case errors.Is(err, errImageTooManyPixels):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": limitErr.Err.Error(), "code": "image_too_many_pixels",
+			"item": limitErr.Item, "max_megapixels": config.Limits.MaxMegapixels})
+	case errors.Is(err, errImageTimeout):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": limitErr.Err.Error(), "code": "image_processing_timeout",
+			"item": limitErr.Item, "timeout_seconds": config.Limits.ProcessingTimeoutSeconds})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// 制限超過のエラーか
+func isImageLimitError(err error) bool {
+	var limitErr *imageLimitError
+	return errors.As(err, &limitErr)
+}
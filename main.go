@@ -1,8 +1,10 @@
 package main
 
 import (
-	"archive/zip"
+	"bytes"
+	"context"
 	"crypto/md5"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -15,9 +17,7 @@ import (
 	"sync"
 	"time"
 
-	"github.com/disintegration/imaging"
 	"github.com/gin-gonic/gin"
-	"github.com/nwaples/rardecode"
 	"gopkg.in/yaml.v2"
 )
 
@@ -30,20 +30,92 @@ type Config struct {
 	Manga struct {
 		SourcePath string `yaml:"source_path"`
 	} `yaml:"manga"`
+	Archive struct {
+		MaxNestedDepth  int `yaml:"max_nested_depth"`
+		MaxNestedSizeMB int `yaml:"max_nested_size_mb"`
+		NestedCacheSize int `yaml:"nested_cache_size"`
+		PasswordsFile   string            `yaml:"passwords_file"`
+		Passwords       []ArchivePassword `yaml:"passwords"`
+	} `yaml:"archive"`
+	Admin struct {
+		Token string `yaml:"token"`
+	} `yaml:"admin"`
+	Libraries []LibraryConfig `yaml:"libraries"`
 	Cache struct {
 		MaxSize               int `yaml:"max_size"`
 		TTLMinutes           int `yaml:"ttl_minutes"`
 		CleanupIntervalMinutes int `yaml:"cleanup_interval_minutes"`
+		VariantMaxSize         int `yaml:"variant_max_size"`
+		MetadataMaxSize        int `yaml:"metadata_max_size"`
 	} `yaml:"cache"`
 	Prefetch struct {
 		Count   int  `yaml:"count"`
 		Enabled bool `yaml:"enabled"`
 	} `yaml:"prefetch"`
 	Performance struct {
-		ImageQuality   int `yaml:"image_quality"`
-		MaxImageWidth  int `yaml:"max_image_width"`
-		MaxImageHeight int `yaml:"max_image_height"`
+		ImageQuality    int                        `yaml:"image_quality"`
+		MaxImageWidth   int                        `yaml:"max_image_width"`
+		MaxImageHeight  int                        `yaml:"max_image_height"`
+		DefaultProfile  string                     `yaml:"default_profile"`
+		SaveDataQuality int                        `yaml:"save_data_quality"`
+		Profiles        map[string]DeliveryProfile `yaml:"profiles"`
 	} `yaml:"performance"`
+	Eink struct {
+		Profile  string  `yaml:"profile"`
+		Levels   int     `yaml:"levels"`
+		Dither   bool    `yaml:"dither"`
+		Contrast float64 `yaml:"contrast"`
+		Gamma    float64 `yaml:"gamma"`
+	} `yaml:"eink"`
+	Pairing struct {
+		OffsetsFile string `yaml:"offsets_file"`
+	} `yaml:"pairing"`
+	Rotation struct {
+		RotationsFile string `yaml:"rotations_file"`
+	} `yaml:"rotation"`
+	Spread struct {
+		MinAspectRatio float64 `yaml:"min_aspect_ratio"`
+	} `yaml:"spread"`
+	Webtoon struct {
+		SliceHeight    int     `yaml:"slice_height"`
+		MinAspectRatio float64 `yaml:"min_aspect_ratio"`
+	} `yaml:"webtoon"`
+	Zoom struct {
+		TileSize         int `yaml:"tile_size"`
+		Overlap          int `yaml:"overlap"`
+		Quality          int `yaml:"quality"`
+		CachedImages     int `yaml:"cached_images"`
+		CachedMegapixels int `yaml:"cached_megapixels"`
+	} `yaml:"zoom"`
+	Crop struct {
+		Tolerance    int `yaml:"tolerance"`
+		NoisePercent int `yaml:"noise_percent"`
+	} `yaml:"crop"`
+	Enhance struct {
+		BlackPercent float64 `yaml:"black_percent"`
+		WhitePercent float64 `yaml:"white_percent"`
+		Sharpen      float64 `yaml:"sharpen"`
+	} `yaml:"enhance"`
+	ContactSheet struct {
+		TileWidth  int `yaml:"tile_width"`
+		TileHeight int `yaml:"tile_height"`
+		Columns    int `yaml:"columns"`
+		Rows       int `yaml:"rows"`
+		Quality    int `yaml:"quality"`
+	} `yaml:"contact_sheet"`
+	Scheduler struct {
+		Workers int `yaml:"workers"`
+	} `yaml:"scheduler"`
+	OPDS struct {
+		Title              string `yaml:"title"`
+		PageSize           int    `yaml:"page_size"`
+		SearchIndexMinutes int    `yaml:"search_index_minutes"`
+	} `yaml:"opds"`
+	Limits struct {
+		MaxImageSizeMB           int     `yaml:"max_image_size_mb"`
+		MaxMegapixels            float64 `yaml:"max_megapixels"`
+		ProcessingTimeoutSeconds int     `yaml:"processing_timeout_seconds"`
+	} `yaml:"limits"`
 	Logging struct {
 		Level           string `yaml:"level"`
 		EnableAccessLog bool   `yaml:"enable_access_log"`
@@ -55,8 +127,16 @@ type FileInfo struct {
 	Name      string `json:"name"`
 	Path      string `json:"path"`
 	IsDir     bool   `json:"is_dir"`
+	IsArchive bool   `json:"is_archive,omitempty"`
+	Volumes   int    `json:"volumes,omitempty"`
 	Size      int64  `json:"size"`
 	Extension string `json:"extension"`
+	Placeholder string `json:"placeholder,omitempty"` // 読み込み中に表示するBlurHash
+	Width       int    `json:"width,omitempty"`
+	Height      int    `json:"height,omitempty"`
+	Orientation string `json:"orientation,omitempty"`
+	Format      string `json:"format,omitempty"`
+	Animated    bool   `json:"animated,omitempty"`
 }
 
 // CacheEntry キャッシュエントリ
@@ -94,6 +174,18 @@ func main() {
 	// キャッシュ初期化
 	initCache()
 	
+	// 画像処理スケジューラー初期化
+	initImageScheduler()
+	
+	// アーカイブパスワード初期化
+	initPasswordStore()
+	
+	// 見開きオフセット初期化
+	initPageOffsetStore()
+	
+	// ページ回転初期化
+	initPageRotationStore()
+	
 	// 定期的なキャッシュクリーンアップを開始
 	go func() {
 		cleanupInterval := time.Duration(config.Cache.CleanupIntervalMinutes) * time.Minute
@@ -103,6 +195,8 @@ func main() {
 			select {
 			case <-ticker.C:
 				imageCache.Cleanup()
+				nestedArchiveCache.Cleanup()
+				variantCache.Cleanup()
 				log.Printf("Cache cleanup completed")
 			}
 		}
@@ -145,6 +239,12 @@ func initConfig() {
 	if port := os.Getenv("PORT"); port != "" {
 		config.Server.Port = port
 	}
+	if adminToken := os.Getenv("ADMIN_TOKEN"); adminToken != "" {
+		config.Admin.Token = adminToken
+	}
+	
+	// 配信プロファイルの補完
+	ensureDefaultProfiles()
 	
 	log.Printf("Configuration loaded - Source: %s, Host: %s, Port: %s", 
 		config.Manga.SourcePath, config.Server.Host, config.Server.Port)
@@ -154,14 +254,54 @@ func setDefaultConfig() {
 	config.Server.Host = "0.0.0.0"
 	config.Server.Port = "8080"
 	config.Manga.SourcePath = "S:/comic"
+	config.Archive.MaxNestedDepth = 2
+	config.Archive.MaxNestedSizeMB = 128 // 展開した内側アーカイブはメモリに保持するため、キャッシュ数との積が最大の使用量になる
+	config.Archive.NestedCacheSize = 2
+	config.Archive.PasswordsFile = "passwords.json"
 	config.Cache.MaxSize = 500
 	config.Cache.TTLMinutes = 60
 	config.Cache.CleanupIntervalMinutes = 10
+	config.Cache.VariantMaxSize = 200
+	config.Cache.MetadataMaxSize = 1000
 	config.Prefetch.Count = 100
 	config.Prefetch.Enabled = true
 	config.Performance.ImageQuality = 85
 	config.Performance.MaxImageWidth = 1920
 	config.Performance.MaxImageHeight = 1080
+	config.Performance.DefaultProfile = profileDesktop
+	config.Performance.SaveDataQuality = 60
+	config.Eink.Profile = profileEink
+	config.Eink.Levels = 16
+	config.Eink.Dither = true
+	config.Eink.Contrast = 20
+	config.Eink.Gamma = 0.9
+	config.Pairing.OffsetsFile = "page_offsets.json"
+	config.Rotation.RotationsFile = "page_rotations.json"
+	config.Spread.MinAspectRatio = 1.0
+	config.Webtoon.SliceHeight = 2000
+	config.Webtoon.MinAspectRatio = 2.5
+	config.Zoom.TileSize = 254
+	config.Zoom.Overlap = 1
+	config.Zoom.Quality = 80
+	config.Zoom.CachedImages = 8
+	config.Zoom.CachedMegapixels = 100
+	config.Crop.Tolerance = 32
+	config.Crop.NoisePercent = 5
+	config.Enhance.BlackPercent = 1
+	config.Enhance.WhitePercent = 1
+	config.Enhance.Sharpen = 0.6
+	config.ContactSheet.TileWidth = 120
+	config.ContactSheet.TileHeight = 170
+	config.ContactSheet.Columns = 10
+	config.ContactSheet.Rows = 10
+	config.ContactSheet.Quality = 75
+	config.Scheduler.Workers = defaultSchedulerWorkers
+	config.OPDS.Title = "Manga Server"
+	config.OPDS.PageSize = 100
+	config.OPDS.SearchIndexMinutes = 10
+	config.Limits.MaxImageSizeMB = 64
+	config.Limits.MaxMegapixels = 150
+	config.Limits.ProcessingTimeoutSeconds = 30
 	config.Logging.Level = "info"
 	config.Logging.EnableAccessLog = true
 }
@@ -183,6 +323,8 @@ func initCache() {
 		ttl:     time.Duration(config.Cache.TTLMinutes) * time.Minute,
 	}
 	prefetchStatus = make(map[string]*PrefetchStatus)
+	initNestedArchiveCache()
+	initVariantCache()
 	log.Printf("Image cache initialized - MaxSize: %d, TTL: %v", imageCache.maxSize, imageCache.ttl)
 }
 
@@ -265,12 +407,50 @@ func setupRoutes(r *gin.Engine) {
 		api.GET("/directories", listDirectories)
 		api.GET("/files/*path", listFiles)
 		api.GET("/image/*path", serveImage)         // 新機能: 画像配信
+		api.HEAD("/image/*path", serveImage)
 		api.GET("/archive/*path", extractArchive)   // 新機能: アーカイブ展開
 		api.GET("/archive-image/*path", serveArchiveImage) // 新機能: アーカイブ内画像配信
+		api.HEAD("/archive-image/*path", serveArchiveImage)
 		api.GET("/prefetch/*path", prefetchImages) // 新機能: 画像プリフェッチ
 		api.GET("/cache-status", getCacheStatus) // 新機能: キャッシュ状況確認
 		api.GET("/prefetch-status/*path", getPrefetchStatus) // 新機能: プリフェッチ状況確認
+		api.GET("/scheduler-status", getSchedulerStatus)
 		api.GET("/thumbnail/*path", serveThumbnail) // 新機能: サムネイル
+		api.GET("/profiles", listDeliveryProfiles)
+		api.GET("/pages/*path", listVirtualPages)
+		api.GET("/pairs/*path", listPagePairs)
+		api.PUT("/pairs/*path", adminAuthMiddleware(), setPageOffset) // 保存は管理APIと同じ認証が必要
+		api.GET("/rotation/*path", getPageRotation)
+		api.PUT("/rotation/*path", adminAuthMiddleware(), setPageRotation) // 保存は管理APIと同じ認証が必要
+		api.GET("/contact-sheet/*path", getContactSheet)
+		api.GET("/contact-sheet-image/*path", serveContactSheetImage)
+		api.GET("/strip/*path", listStripSlices)
+		api.GET("/zoom/*path", serveZoom)
+		api.GET("/download/*path", downloadArchive)
+		api.HEAD("/download/*path", downloadArchive)
+		
+		// 管理API（admin.tokenによる認証が必要）
+		admin := api.Group("/admin", adminAuthMiddleware())
+		{
+			admin.GET("/passwords", listArchivePasswords)
+			admin.PUT("/passwords", setArchivePassword)
+			admin.DELETE("/passwords/*path", deleteArchivePassword)
+		}
+	}
+	
+	// OPDSカタログ（OPDS 1.2: Atom、OPDS 2.0: JSON）
+	opds := r.Group("/opds")
+	{
+		opds.GET("", func(c *gin.Context) {
+			c.Redirect(http.StatusFound, catalogURL(opdsV1Prefix, ""))
+		})
+		opds.GET("/v1.2/catalog/*path", opdsCatalog)
+		opds.GET("/v1.2/search", opdsSearch)
+		opds.GET("/v1.2/opensearch.xml", opdsOpenSearch)
+		opds.GET("/v2/catalog/*path", opds2Catalog)
+		opds.GET("/v2/search", opds2Search)
+		opds.GET("/pse/*path", serveStreamPage) // OPDS-PSE: ページ単位の配信
+		opds.HEAD("/pse/*path", serveStreamPage)
 	}
 	
 	// フロントエンドページ
@@ -280,6 +460,7 @@ func setupRoutes(r *gin.Engine) {
 
 // インデックスページ
 func indexPage(c *gin.Context) {
+	c.Header("Accept-CH", clientHintsHeaders)
 	c.HTML(http.StatusOK, "index.html", gin.H{
 		"title": "Manga Server - 軽量Web漫画リーダー",
 	})
@@ -298,6 +479,7 @@ func viewerPage(c *gin.Context) {
 		decodedPath = path
 	}
 	
+	c.Header("Accept-CH", clientHintsHeaders)
 	c.HTML(http.StatusOK, "viewer.html", gin.H{
 		"Title": decodedPath,
 		"Path":  path,
@@ -357,6 +539,45 @@ func listFiles(c *gin.Context) {
 	fullPath := filepath.Join(config.Manga.SourcePath, decodedPath)
 	log.Printf("Listing files: %s -> %s -> %s", requestPath, decodedPath, fullPath)
 	
+	// アーカイブまたはアーカイブ内のフォルダの場合は直下のフォルダ・ページ・子アーカイブを返す
+	if _, statErr := os.Stat(fullPath); statErr != nil || isArchiveFile(strings.ToLower(filepath.Ext(decodedPath))) {
+		ref, folder, err := splitArchivePath(decodedPath)
+		if err != nil {
+			respondArchiveError(c, err)
+			return
+		}
+		archiveFiles, err := listArchiveFiles(ref)
+		if err != nil {
+			respondArchiveError(c, err)
+			return
+		}
+		if placeholdersRequested(c) {
+			placeholders, pending := archivePlaceholders(ref)
+			setPlaceholdersPending(c, pending)
+			attachPlaceholders(archiveFiles, placeholders)
+		}
+		if pageMetaRequested(c) {
+			metas, err := archivePageMeta(ref)
+			if err != nil {
+				respondArchiveError(c, err)
+				return
+			}
+			attachPageMeta(archiveFiles, metas)
+		}
+		files, found := listArchiveFolder(archiveFiles, folder)
+		if !found {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Folder not found in archive", "folder": folder})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"files":     files,
+			"count":     len(files),
+			"path":      requestPath,
+			"full_path": fullPath,
+		})
+		return
+	}
+	
 	files, err := scanFiles(fullPath)
 	if err != nil {
 		log.Printf("Failed to scan files in: %s (error: %v)", fullPath, err)
@@ -366,6 +587,18 @@ func listFiles(c *gin.Context) {
 		return
 	}
 	
+	if placeholdersRequested(c) {
+		placeholders, pending := directoryPlaceholders(fullPath)
+		setPlaceholdersPending(c, pending)
+		attachPlaceholders(files, placeholders)
+	}
+	
+	if pageMetaRequested(c) {
+		if metas, err := directoryPageMeta(fullPath); err == nil {
+			attachPageMeta(files, metas)
+		}
+	}
+	
 	c.JSON(http.StatusOK, gin.H{
 		"files":     files,
 		"count":     len(files),
@@ -425,6 +658,9 @@ func scanFiles(dirPath string) ([]FileInfo, error) {
 		".cbz":  true,
 	}
 	
+	// 分割RAR（name.part1.rar 等）のボリュームを検出
+	volumes := collectRarVolumes(entries)
+	
 	for _, entry := range entries {
 		info, err := entry.Info()
 		if err != nil {
@@ -435,13 +671,24 @@ func scanFiles(dirPath string) ([]FileInfo, error) {
 		
 		// ディレクトリまたはサポートファイルのみ
 		if entry.IsDir() || supportedExts[ext] {
-			files = append(files, FileInfo{
+			fileInfo := FileInfo{
 				Name:      entry.Name(),
 				Path:      entry.Name(),
 				IsDir:     entry.IsDir(),
 				Size:      info.Size(),
 				Extension: ext,
-			})
+			}
+			
+			// 分割RARは最初のボリュームのみを1つのアーカイブとして表示
+			if volume, ok := volumes[entry.Name()]; ok {
+				if !volume.First {
+					continue
+				}
+				fileInfo.Volumes = volume.Count
+				fileInfo.Size = volume.TotalSize
+			}
+			
+			files = append(files, fileInfo)
 		}
 	}
 	
@@ -453,8 +700,9 @@ func corsMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		c.Header("Access-Control-Allow-Origin", "*")
 		c.Header("Access-Control-Allow-Credentials", "true")
-		c.Header("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With")
-		c.Header("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT")
+		c.Header("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With, If-None-Match, If-Modified-Since, Range, If-Range")
+		c.Header("Access-Control-Allow-Methods", "POST, OPTIONS, GET, HEAD, PUT, DELETE")
+		c.Header("Access-Control-Expose-Headers", "ETag, Last-Modified, Content-Range, Accept-Ranges, X-Delivery-Profile, X-Placeholders-Pending")
 
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(204)
@@ -484,11 +732,6 @@ func serveImage(c *gin.Context) {
 	fullPath := filepath.Join(config.Manga.SourcePath, decodedPath)
 	log.Printf("Serving image: %s -> %s -> %s", requestPath, decodedPath, fullPath)
 	
-	// リサイズパラメータ
-	width := c.DefaultQuery("width", "0")
-	height := c.DefaultQuery("height", "0")
-	quality := c.DefaultQuery("quality", "85")
-	
 	// ファイル存在確認
 	if _, err := os.Stat(fullPath); os.IsNotExist(err) {
 		log.Printf("Image not found: %s", fullPath)
@@ -503,21 +746,21 @@ func serveImage(c *gin.Context) {
 		return
 	}
 	
-	// リサイズが必要かチェック
-	w, _ := strconv.Atoi(width)
-	h, _ := strconv.Atoi(height)
-	q, _ := strconv.Atoi(quality)
-	
-	if w > 0 || h > 0 {
-		// リサイズして配信
-		if err := serveResizedImage(c, fullPath, w, h, q); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	// 配信プロファイルを適用し、リサイズまたは形式変換が必要な場合は変換して配信
+	opts, transform := profileImageOptions(c, decodedPath, imageConfigFromFile(fullPath), isAnimatedGIFFile(fullPath))
+	if transform || fileHasEXIFOrientation(fullPath) {
+		if err := serveResizedImage(c, fullPath, opts); err != nil {
+			respondImageError(c, err)
 		}
 		return
 	}
 	
-	// オリジナル画像を配信
-	c.File(fullPath)
+	// オリジナル画像を配信（ETagは元ファイルの識別子から生成）
+	validator := newImageValidator(fileSourceKey(fullPath), fullPath)
+	if respondNotModified(c, validator) {
+		return
+	}
+	serveImageFile(c, fullPath, validator)
 }
 
 // アーカイブ展開機能
@@ -538,38 +781,62 @@ func extractArchive(c *gin.Context) {
 	fullPath := filepath.Join(config.Manga.SourcePath, decodedPath)
 	log.Printf("Extracting archive: %s -> %s -> %s", requestPath, decodedPath, fullPath)
 	
-	// ファイル存在確認
-	if _, err := os.Stat(fullPath); os.IsNotExist(err) {
-		log.Printf("Archive not found: %s", fullPath)
-		c.JSON(http.StatusNotFound, gin.H{"error": "Archive not found", "path": fullPath})
+	// アーカイブ参照とアーカイブ内のフォルダを解決（アーカイブ内のアーカイブを含む）
+	ref, folder, err := splitArchivePath(decodedPath)
+	if err != nil {
+		log.Printf("Archive not found: %s (error: %v)", fullPath, err)
+		respondArchiveError(c, err)
 		return
 	}
 	
-	ext := strings.ToLower(filepath.Ext(fullPath))
+	files, archiveErr := listArchiveFiles(ref)
+	if archiveErr != nil {
+		respondArchiveError(c, archiveErr)
+		return
+	}
 	
-	var files []FileInfo
-	var archiveErr error
+	// 読み込み中に表示するプレースホルダー（フォルダ一覧にも引き継がれる）
+	if placeholdersRequested(c) {
+		placeholders, pending := archivePlaceholders(ref)
+		setPlaceholdersPending(c, pending)
+		attachPlaceholders(files, placeholders)
+	}
 	
-	switch ext {
-	case ".zip", ".cbz":
-		files, archiveErr = extractZipFiles(fullPath)
-	case ".rar", ".cbr":
-		files, archiveErr = extractRarFiles(fullPath)
-	default:
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported archive format"})
-		return
+	// 各ページのサイズ・形式（ヘッダーのみ読み込み、インデックスとしてキャッシュ）
+	if pageMetaRequested(c) {
+		metas, err := archivePageMeta(ref)
+		if err != nil {
+			respondArchiveError(c, err)
+			return
+		}
+		attachPageMeta(files, metas)
 	}
 	
-	if archiveErr != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": archiveErr.Error()})
+	// アーカイブ内のフォルダが指定された場合はその直下のみを返す
+	if folder != "" {
+		entries, found := listArchiveFolder(files, folder)
+		if !found {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Folder not found in archive", "folder": folder})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"files":        entries,
+			"count":        len(entries),
+			"archive_path": requestPath,
+			"archive_type": ref.Ext(),
+			"folder":       folder,
+			"nested_depth": len(ref.Inner),
+		})
 		return
 	}
 	
 	c.JSON(http.StatusOK, gin.H{
 		"files":        files,
 		"count":        len(files),
+		"tree":         buildArchiveTree(files),
 		"archive_path": requestPath,
-		"archive_type": ext,
+		"archive_type": ref.Ext(),
+		"nested_depth": len(ref.Inner),
 	})
 }
 
@@ -588,29 +855,22 @@ func serveArchiveImage(c *gin.Context) {
 		decodedPath = decodedPath[1:]
 	}
 	
-	// パスからアーカイブファイルパスと画像ファイル名を分離
-	parts := strings.Split(decodedPath, "/")
-	if len(parts) < 2 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid path format"})
+	// パスからアーカイブ参照と画像ファイル名を分離（アーカイブ内のアーカイブを含む）
+	ref, imageName, err := splitArchivePath(decodedPath)
+	if err != nil {
+		log.Printf("Archive not found: %s (error: %v)", decodedPath, err)
+		respondArchiveError(c, err)
 		return
 	}
-	
-	// 最後の要素が画像ファイル名、それ以外がアーカイブパス
-	imageName := parts[len(parts)-1]
-	archivePath := strings.Join(parts[:len(parts)-1], "/")
-	
-	fullArchivePath := filepath.Join(config.Manga.SourcePath, archivePath)
-	log.Printf("Serving archive image: %s -> archive: %s, image: %s", requestPath, fullArchivePath, imageName)
-	
-	// アーカイブファイル存在確認
-	if _, err := os.Stat(fullArchivePath); os.IsNotExist(err) {
-		log.Printf("Archive not found: %s", fullArchivePath)
-		c.JSON(http.StatusNotFound, gin.H{"error": "Archive not found"})
+	if imageName == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid path format"})
 		return
 	}
 	
+	log.Printf("Serving archive image: %s -> archive: %s, image: %s", requestPath, ref.Key(), imageName)
+	
 	// キャッシュキー生成
-	cacheKey := generateCacheKey(fullArchivePath, imageName)
+	cacheKey := generateCacheKey(ref.Key(), imageName)
 	
 	// キャッシュから画像取得を試行
 	var imageData []byte
@@ -621,9 +881,13 @@ func serveArchiveImage(c *gin.Context) {
 	} else {
 		log.Printf("Cache miss for: %s, extracting from archive", cacheKey)
 		// アーカイブから画像を抽出
-		imageData, err = extractImageFromArchive(fullArchivePath, imageName)
+		imageData, err = extractImageFromArchive(ref, imageName)
 		if err != nil {
 			log.Printf("Failed to extract image from archive: %v", err)
+			if isPasswordError(err) || isImageLimitError(err) {
+				respondArchiveError(c, err)
+				return
+			}
 			c.JSON(http.StatusNotFound, gin.H{"error": "Image not found in archive"})
 			return
 		}
@@ -633,23 +897,22 @@ func serveArchiveImage(c *gin.Context) {
 		log.Printf("Cached image: %s (size: %d bytes)", cacheKey, len(imageData))
 	}
 	
-	// リサイズパラメータ
-	width := c.DefaultQuery("width", "0")
-	height := c.DefaultQuery("height", "0")
-	quality := c.DefaultQuery("quality", "85")
-	
-	w, _ := strconv.Atoi(width)
-	h, _ := strconv.Atoi(height)
-	q, _ := strconv.Atoi(quality)
-	
-	if w > 0 || h > 0 {
-		// リサイズして配信
-		if err := serveResizedImageFromData(c, imageData, w, h, q); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	// 配信プロファイルを適用し、リサイズまたは形式変換が必要な場合は変換して配信
+	opts, transform := profileImageOptions(c, decodedPath, imageConfigFromData(imageData), isAnimatedGIF(imageData))
+	if transform || hasEXIFOrientation(imageData) {
+		if err := serveResizedImageFromData(c, imageData, archiveSourceKey(ref, imageName), ref.DiskPath, opts); err != nil {
+			respondImageError(c, err)
 		}
 		return
 	}
 	
+	// 元画像のまま配信する場合のみエントリの識別子から生成したETagで再検証
+	// （変換する場合は変換後の画像のキーで再検証）
+	validator := newImageValidator(archiveSourceKey(ref, imageName), ref.DiskPath)
+	if respondNotModified(c, validator) {
+		return
+	}
+	
 	// 画像形式を判定
 	ext := strings.ToLower(filepath.Ext(imageName))
 	var contentType string
@@ -667,9 +930,7 @@ func serveArchiveImage(c *gin.Context) {
 	}
 	
 	// 画像データを直接配信
-	c.Header("Content-Type", contentType)
-	c.Header("Cache-Control", "public, max-age=3600")
-	c.Data(http.StatusOK, contentType, imageData)
+	serveImageContent(c, contentType, imageData, validator)
 }
 
 // 画像プリフェッチ機能
@@ -687,48 +948,34 @@ func prefetchImages(c *gin.Context) {
 		decodedPath = decodedPath[1:]
 	}
 	
-	// パスからアーカイブファイルパスと画像ファイル名を分離
-	parts := strings.Split(decodedPath, "/")
-	if len(parts) < 2 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid path format"})
+	// パスからアーカイブ参照と画像ファイル名を分離（アーカイブ内のアーカイブを含む）
+	ref, currentImageName, err := splitArchivePath(decodedPath)
+	if err != nil {
+		respondArchiveError(c, err)
 		return
 	}
-	
-	// 最後の要素が画像ファイル名、それ以外がアーカイブパス
-	currentImageName := parts[len(parts)-1]
-	archivePath := strings.Join(parts[:len(parts)-1], "/")
-	
-	fullArchivePath := filepath.Join(config.Manga.SourcePath, archivePath)
-	
-	// アーカイブファイル存在確認
-	if _, err := os.Stat(fullArchivePath); os.IsNotExist(err) {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Archive not found"})
+	if currentImageName == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid path format"})
 		return
 	}
 	
-	// アーカイブ内のファイル一覧を取得
-	ext := strings.ToLower(filepath.Ext(fullArchivePath))
-	var files []FileInfo
-	
-	switch ext {
-	case ".zip", ".cbz":
-		files, err = extractZipFiles(fullArchivePath)
-	case ".rar", ".cbr":
-		files, err = extractRarFiles(fullArchivePath)
-	default:
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported archive format"})
-		return
-	}
+	// プリフェッチ状況はリクエストパス単位で管理
+	fullArchivePath := filepath.Join(config.Manga.SourcePath, strings.TrimSuffix(decodedPath, "/"+currentImageName))
 	
+	// アーカイブ内のファイル一覧を取得
+	files, err := listArchiveFiles(ref)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondArchiveError(c, err)
 		return
 	}
 	
-	// 現在の画像のインデックスを見つける
+	// 画像のみをページ順に対象とする
+	files = sortedArchivePages(files)
+	
+	// 現在の画像のインデックスを見つける（アーカイブ内のフルパスで比較）
 	currentIndex := -1
 	for i, file := range files {
-		if file.Name == currentImageName {
+		if file.Path == currentImageName {
 			currentIndex = i
 			break
 		}
@@ -788,22 +1035,26 @@ func prefetchImages(c *gin.Context) {
 		
 		for i := 1; i <= prefetchCount && currentIndex+i < len(files); i++ {
 			nextImage := files[currentIndex+i]
-			cacheKey := generateCacheKey(fullArchivePath, nextImage.Name)
+			cacheKey := generateCacheKey(ref.Key(), nextImage.Path)
 			
 			// すでにキャッシュされているかチェック
 			if _, found := imageCache.Get(cacheKey); !found {
-				// キャッシュされていない場合のみ抽出
-				imageData, err := extractImageFromArchive(fullArchivePath, nextImage.Name)
+				// キャッシュされていない場合のみ抽出（表示中のページの処理を優先）
+				var imageData []byte
+				var err error
+				imageScheduler.Run(context.Background(), priorityPrefetch, func() {
+					imageData, err = extractImageFromArchive(ref, nextImage.Path)
+				})
 				if err == nil {
 					imageCache.Set(cacheKey, imageData)
 					prefetched++
-					log.Printf("Prefetched image: %s (%d/%d)", nextImage.Name, prefetched, prefetchCount)
+					log.Printf("Prefetched image: %s (%d/%d)", nextImage.Path, prefetched, prefetchCount)
 				} else {
-					log.Printf("Failed to prefetch image: %s, error: %v", nextImage.Name, err)
+					log.Printf("Failed to prefetch image: %s, error: %v", nextImage.Path, err)
 				}
 			} else {
 				prefetched++
-				log.Printf("Image already cached: %s (%d/%d)", nextImage.Name, prefetched, prefetchCount)
+				log.Printf("Image already cached: %s (%d/%d)", nextImage.Path, prefetched, prefetchCount)
 			}
 			
 			// プリフェッチ状況を更新
@@ -826,35 +1077,21 @@ func prefetchImages(c *gin.Context) {
 
 // キャッシュ状況確認API
 func getCacheStatus(c *gin.Context) {
-	imageCache.mutex.RLock()
-	defer imageCache.mutex.RUnlock()
+	status := imageCacheStats(imageCache)
+	status["ttl_minutes"] = int(imageCache.ttl.Minutes())
+	status["cache_hit_ratio"] = calculateCacheHitRatio()
+	status["variant_cache"] = imageCacheStats(variantCache)
 	
-	totalSize := int64(0)
-	expiredCount := 0
-	now := time.Now()
-	
-	for _, entry := range imageCache.cache {
-		totalSize += int64(len(entry.Data))
-		if now.Sub(entry.Timestamp) > imageCache.ttl {
-			expiredCount++
-		}
-	}
-	
-	c.JSON(http.StatusOK, gin.H{
-		"cache_entries": len(imageCache.cache),
-		"max_size": imageCache.maxSize,
-		"total_memory_bytes": totalSize,
-		"total_memory_mb": float64(totalSize) / 1024 / 1024,
-		"expired_entries": expiredCount,
-		"ttl_minutes": int(imageCache.ttl.Minutes()),
-		"cache_hit_ratio": calculateCacheHitRatio(),
-	})
+	c.JSON(http.StatusOK, status)
 }
 
 // キャッシュヒット率計算（簡易版）
 func calculateCacheHitRatio() float64 {
 	// 実際の実装では、ヒット/ミスのカウンターを追加する必要があります
 	// ここでは簡易的にキャッシュエントリ数から推定
+	imageCache.mutex.RLock()
+	defer imageCache.mutex.RUnlock()
+	
 	if imageCache.maxSize == 0 {
 		return 0.0
 	}
@@ -924,6 +1161,7 @@ func serveThumbnail(c *gin.Context) {
 	
 	fullPath := filepath.Join(config.Manga.SourcePath, decodedPath)
 	log.Printf("Generating thumbnail: %s -> %s -> %s", requestPath, decodedPath, fullPath)
+	c.Set(priorityContextKey, priorityThumbnail)
 	
 	size := c.DefaultQuery("size", "200")
 	thumbnailSize, _ := strconv.Atoi(size)
@@ -931,6 +1169,9 @@ func serveThumbnail(c *gin.Context) {
 		thumbnailSize = 200
 	}
 	
+	// サムネイルにするページ（ページごとの回転の参照に使用）
+	pagePath := decodedPath
+	
 	// ディレクトリの場合は最初の画像ファイルを探す
 	if info, err := os.Stat(fullPath); err == nil && info.IsDir() {
 		firstImage, err := findFirstImage(fullPath)
@@ -940,23 +1181,33 @@ func serveThumbnail(c *gin.Context) {
 			return
 		}
 		fullPath = firstImage
+		if rel, err := filepath.Rel(config.Manga.SourcePath, firstImage); err == nil {
+			pagePath = filepath.ToSlash(rel)
+		}
 		log.Printf("Found first image: %s", fullPath)
 	}
 	
-	// アーカイブファイルの場合は最初の画像を抽出
+	// アーカイブ（またはアーカイブ内のフォルダ・画像）の場合は画像を抽出
 	ext := strings.ToLower(filepath.Ext(fullPath))
-	if isArchiveFile(ext) {
+	if _, statErr := os.Stat(fullPath); isArchiveFile(ext) || statErr != nil {
 		log.Printf("Extracting thumbnail from archive: %s", fullPath)
-		firstImage, err := extractFirstImageFromArchive(fullPath)
+		ref, entry, err := splitArchivePath(decodedPath)
+		if err != nil {
+			respondArchiveError(c, err)
+			return
+		}
+		firstImage, firstPage, err := extractImageForThumbnail(ref, entry)
 		if err != nil {
 			log.Printf("Failed to extract image from archive: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			respondArchiveError(c, err)
 			return
 		}
 		
 		// 一時ファイルから読み込み
-		if err := serveResizedImageFromData(c, firstImage, thumbnailSize, thumbnailSize, 85); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		_, profile := selectDeliveryProfile(c)
+		opts := newImageOptions(c, firstPage, thumbnailSize, thumbnailSize, profile.quality())
+		if err := serveResizedImageFromData(c, firstImage, archiveSourceKey(ref, "thumbnail:"+entry), ref.DiskPath, opts); err != nil {
+			respondImageError(c, err)
 		}
 		return
 	}
@@ -968,8 +1219,10 @@ func serveThumbnail(c *gin.Context) {
 	}
 	
 	log.Printf("Generating thumbnail for image: %s", fullPath)
-	if err := serveResizedImage(c, fullPath, thumbnailSize, thumbnailSize, 85); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	_, profile := selectDeliveryProfile(c)
+	opts := newImageOptions(c, pagePath, thumbnailSize, thumbnailSize, profile.quality())
+	if err := serveResizedImage(c, fullPath, opts); err != nil {
+		respondImageError(c, err)
 	}
 }
 
@@ -990,62 +1243,158 @@ func isArchiveFile(ext string) bool {
 }
 
 // リサイズした画像を配信
-func serveResizedImage(c *gin.Context, imagePath string, width, height, quality int) error {
+func serveResizedImage(c *gin.Context, imagePath string, opts imageOptions) error {
 	// 画像を読み込み
-	img, err := imaging.Open(imagePath)
+	imageData, err := readImageFile(imagePath)
 	if err != nil {
+		if isImageLimitError(err) {
+			return err
+		}
 		return fmt.Errorf("failed to open image: %v", err)
 	}
 	
-	// リサイズ処理
-	if width > 0 && height > 0 {
-		img = imaging.Fit(img, width, height, imaging.Lanczos)
-	} else if width > 0 {
-		img = imaging.Resize(img, width, 0, imaging.Lanczos)
-	} else if height > 0 {
-		img = imaging.Resize(img, 0, height, imaging.Lanczos)
+	return serveResizedImageFromData(c, imageData, fileSourceKey(imagePath), imagePath, opts)
+}
+
+// データから画像をリサイズして配信（sourceKeyは変換結果のキャッシュとETag、diskPathはLast-Modifiedに使用）
+func serveResizedImageFromData(c *gin.Context, imageData []byte, sourceKey, diskPath string, opts imageOptions) error {
+	// 変換済みの結果はキャッシュから配信
+	variantKey := ""
+	var validator imageValidator
+	if sourceKey != "" {
+		variantKey = variantCacheKey(sourceKey, opts, imageData)
+		
+		// 条件付きリクエストは変換せずに304を返す
+		validator = newImageValidator(variantKey, diskPath)
+		if respondNotModified(c, validator) {
+			if acceptMayVary(opts) {
+				c.Writer.Header().Add("Vary", "Accept")
+			}
+			return nil
+		}
+		
+		if cached, found := variantCache.Get(variantKey); found {
+			format := detectImageFormat(cached)
+			setEncodedImageHeaders(c, format, acceptMayVary(opts))
+			serveImageContent(c, imageFormatContentType(format), cached, validator)
+			return nil
+		}
 	}
 	
-	// Content-Type設定
-	c.Header("Content-Type", "image/jpeg")
-	c.Header("Cache-Control", "public, max-age=3600")
+	// デコードから変換まで優先度順に、時間の上限付きで実行（実行枠は処理が終わるまで保持）
+	item := c.Request.URL.Path
+	rendered, err := renderWithTimeout(c, item, func(ctx context.Context) (renderedImage, error) {
+		return renderImageVariant(ctx, imageData, item, sourceKey, variantKey, opts)
+	})
+	if errors.Is(err, errSliceNotFound) {
+		c.Header("Cache-Control", "no-store")
+		c.JSON(http.StatusNotFound, gin.H{"error": "Slice not found", "slices": rendered.slices})
+		return nil
+	}
+	if err != nil {
+		return err
+	}
 	
-	// JPEG形式で出力
-	return imaging.Encode(c.Writer, img, imaging.JPEG, imaging.JPEGQuality(quality))
+	if rendered.slices > 0 {
+		c.Header("X-Slice-Count", strconv.Itoa(rendered.slices))
+	}
+	setEncodedImageHeaders(c, rendered.format, rendered.vary)
+	if variantKey == "" {
+		c.Data(http.StatusOK, imageFormatContentType(rendered.format), rendered.data)
+		return nil
+	}
+	serveImageContent(c, imageFormatContentType(rendered.format), rendered.data, validator)
+	return nil
 }
 
-// データから画像をリサイズして配信
-func serveResizedImageFromData(c *gin.Context, imageData []byte, width, height, quality int) error {
-	// バイトデータから画像デコード
-	img, err := imaging.Decode(strings.NewReader(string(imageData)))
+// デコード・変換・エンコードを行い、キャッシュキーがあれば結果を保存
+// 各段階の間でctxを確認し、時間の上限を超えた場合・切断された場合は中断する（キャッシュにも保存しない）
+func renderImageVariant(ctx context.Context, imageData []byte, item, sourceKey, variantKey string, opts imageOptions) (renderedImage, error) {
+	// アニメーションGIFはフレームごとにリサイズ
+	if keepsAnimation(opts) && isAnimatedGIF(imageData) {
+		rendered, err := renderAnimatedGIF(ctx, imageData, item, opts)
+		if err == nil && variantKey != "" {
+			if err := checkRenderContext(ctx, item); err != nil {
+				return renderedImage{}, err
+			}
+			variantCache.Set(variantKey, rendered.data)
+		}
+		return rendered, err
+	}
+	
+	// バイトデータから画像デコード（画素数の上限を超える場合はデコードしない）
+	img, err := decodeImage(imageData, item)
 	if err != nil {
-		return fmt.Errorf("failed to decode image: %v", err)
+		return renderedImage{}, err
+	}
+	if err := checkRenderContext(ctx, item); err != nil {
+		return renderedImage{}, err
 	}
 	
-	// リサイズ処理
-	if width > 0 && height > 0 {
-		img = imaging.Fit(img, width, height, imaging.Lanczos)
-	} else if width > 0 {
-		img = imaging.Resize(img, width, 0, imaging.Lanczos)
-	} else if height > 0 {
-		img = imaging.Resize(img, 0, height, imaging.Lanczos)
+	// ページごとに保存された回転（分割・トリミングは回転後の向きで行う）
+	if opts.Rotate != 0 {
+		img = rotateImage(img, opts.Rotate)
 	}
 	
-	// Content-Type設定
-	c.Header("Content-Type", "image/jpeg")
-	c.Header("Cache-Control", "public, max-age=3600")
+	// 縦長ページは全スライスをまとめて生成してキャッシュ
+	if opts.Slice >= 0 && variantKey != "" {
+		return renderStripSlices(ctx, img, imageData, item, sourceKey, opts)
+	}
 	
-	// JPEG形式で出力
-	return imaging.Encode(c.Writer, img, imaging.JPEG, imaging.JPEGQuality(quality))
+	// 見開きの分割（余白は分割後の各ページで判定）
+	if opts.Half != "" {
+		img = splitSpreadHalf(img, opts.Half)
+	}
+	
+	// 余白の自動トリミング
+	if opts.Crop {
+		img = autoCrop(img)
+	}
+	if err := checkRenderContext(ctx, item); err != nil {
+		return renderedImage{}, err
+	}
+	
+	// リサイズ・出力形式の決定
+	img, format, vary := resizeAndConvert(img, imageData, opts)
+	if err := checkRenderContext(ctx, item); err != nil {
+		return renderedImage{}, err
+	}
+	
+	var encoded bytes.Buffer
+	if err := encodeImage(&encoded, img, format, opts.Quality, opts.Progressive); err != nil {
+		return renderedImage{}, err
+	}
+	if err := checkRenderContext(ctx, item); err != nil {
+		return renderedImage{}, err
+	}
+	if variantKey != "" {
+		variantCache.Set(variantKey, encoded.Bytes())
+	}
+	return renderedImage{data: encoded.Bytes(), format: format, vary: vary}, nil
+}
+
+// アーカイブの内容一覧
+func listArchiveFiles(ref archiveRef) ([]FileInfo, error) {
+	switch ref.Ext() {
+	case ".zip", ".cbz":
+		return extractZipFiles(ref)
+	case ".rar", ".cbr":
+		return extractRarFiles(ref)
+	default:
+		return nil, fmt.Errorf("unsupported archive format")
+	}
 }
 
 // ZIPファイルの内容一覧
-func extractZipFiles(zipPath string) ([]FileInfo, error) {
-	reader, err := zip.OpenReader(zipPath)
+func extractZipFiles(ref archiveRef) ([]FileInfo, error) {
+	reader, closeReader, err := openZipArchive(ref)
 	if err != nil {
 		return nil, err
 	}
-	defer reader.Close()
+	defer closeReader()
+	
+	password := archivePassword(ref)
+	passwordChecked := false
 	
 	var files []FileInfo
 	
@@ -1055,11 +1404,21 @@ func extractZipFiles(zipPath string) ([]FileInfo, error) {
 		}
 		
 		ext := strings.ToLower(filepath.Ext(file.Name))
-		if isImageFile(ext) {
+		
+		// 暗号化エントリがあれば最初の1件でパスワードを検証
+		if isZipEntryEncrypted(file) && !passwordChecked && (isImageFile(ext) || isArchiveFile(ext)) {
+			if err := checkZipPassword(file, password); err != nil {
+				return nil, err
+			}
+			passwordChecked = true
+		}
+		
+		if isImageFile(ext) || isArchiveFile(ext) {
 			files = append(files, FileInfo{
 				Name:      filepath.Base(file.Name),
 				Path:      file.Name,
 				IsDir:     false,
+				IsArchive: isArchiveFile(ext),
 				Size:      int64(file.UncompressedSize64),
 				Extension: ext,
 			})
@@ -1070,17 +1429,12 @@ func extractZipFiles(zipPath string) ([]FileInfo, error) {
 }
 
 // RARファイルの内容一覧
-func extractRarFiles(rarPath string) ([]FileInfo, error) {
-	file, err := os.Open(rarPath)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
-	
-	reader, err := rardecode.NewReader(file, "")
+func extractRarFiles(ref archiveRef) ([]FileInfo, error) {
+	reader, closeReader, err := openRarArchive(ref)
 	if err != nil {
 		return nil, err
 	}
+	defer closeReader()
 	
 	var files []FileInfo
 	
@@ -1090,7 +1444,7 @@ func extractRarFiles(rarPath string) ([]FileInfo, error) {
 			break
 		}
 		if err != nil {
-			return nil, err
+			return nil, classifyRarError(ref, err)
 		}
 		
 		if header.IsDir {
@@ -1098,11 +1452,12 @@ func extractRarFiles(rarPath string) ([]FileInfo, error) {
 		}
 		
 		ext := strings.ToLower(filepath.Ext(header.Name))
-		if isImageFile(ext) {
+		if isImageFile(ext) || isArchiveFile(ext) {
 			files = append(files, FileInfo{
 				Name:      filepath.Base(header.Name),
 				Path:      header.Name,
 				IsDir:     false,
+				IsArchive: isArchiveFile(ext),
 				Size:      header.UnPackedSize,
 				Extension: ext,
 			})
@@ -1134,72 +1489,89 @@ func findFirstImage(dirPath string) (string, error) {
 }
 
 // アーカイブから最初の画像を抽出
-func extractFirstImageFromArchive(archivePath string) ([]byte, error) {
-	ext := strings.ToLower(filepath.Ext(archivePath))
+func extractFirstImageFromArchive(ref archiveRef) ([]byte, string, error) {
+	var data []byte
+	var name, nested string
+	var err error
 	
-	switch ext {
+	switch ref.Ext() {
 	case ".zip", ".cbz":
-		return extractFirstImageFromZip(archivePath)
+		data, name, nested, err = extractFirstImageFromZip(ref)
 	case ".rar", ".cbr":
-		return extractFirstImageFromRar(archivePath)
+		data, name, nested, err = extractFirstImageFromRar(ref)
 	default:
-		return nil, fmt.Errorf("unsupported archive format")
+		return nil, "", fmt.Errorf("unsupported archive format")
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if data != nil {
+		return data, archiveRelPath(ref) + "/" + name, nil
 	}
+	
+	// 画像がなくアーカイブのみを含む場合は最初の子アーカイブから抽出
+	if nested != "" && len(ref.Inner) < config.Archive.MaxNestedDepth {
+		return extractFirstImageFromArchive(ref.child(nested))
+	}
+	
+	return nil, "", fmt.Errorf("no image found in archive")
 }
 
-// ZIPから最初の画像を抽出
-func extractFirstImageFromZip(zipPath string) ([]byte, error) {
-	reader, err := zip.OpenReader(zipPath)
+// ZIPから最初の画像とそのエントリ名を抽出（画像がない場合は最初の子アーカイブ名を返す）
+func extractFirstImageFromZip(ref archiveRef) ([]byte, string, string, error) {
+	reader, closeReader, err := openZipArchive(ref)
 	if err != nil {
-		return nil, err
+		return nil, "", "", err
 	}
-	defer reader.Close()
+	defer closeReader()
 	
+	password := archivePassword(ref)
+	nested := ""
 	for _, file := range reader.File {
 		if file.FileInfo().IsDir() {
 			continue
 		}
 		
 		ext := strings.ToLower(filepath.Ext(file.Name))
+		if isArchiveFile(ext) && nested == "" {
+			nested = file.Name
+		}
 		if isImageFile(ext) {
-			rc, err := file.Open()
-			if err != nil {
-				continue
+			// サイズの上限を超える画像は読み込まない
+			data, err := readZipEntryData(file, password)
+			if errors.Is(err, errEntryTooLarge) {
+				return nil, "", "", newImageLimitError(ref.Key()+"/"+file.Name, errImageTooLarge)
 			}
-			defer rc.Close()
-			
-			data, err := io.ReadAll(rc)
 			if err != nil {
+				if isPasswordError(err) {
+					return nil, "", "", err
+				}
 				continue
 			}
 			
-			return data, nil
+			return data, file.Name, "", nil
 		}
 	}
 	
-	return nil, fmt.Errorf("no image found in archive")
+	return nil, "", nested, nil
 }
 
-// RARから最初の画像を抽出
-func extractFirstImageFromRar(rarPath string) ([]byte, error) {
-	file, err := os.Open(rarPath)
+// RARから最初の画像とそのエントリ名を抽出（画像がない場合は最初の子アーカイブ名を返す）
+func extractFirstImageFromRar(ref archiveRef) ([]byte, string, string, error) {
+	reader, closeReader, err := openRarArchive(ref)
 	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
-	
-	reader, err := rardecode.NewReader(file, "")
-	if err != nil {
-		return nil, err
+		return nil, "", "", err
 	}
+	defer closeReader()
 	
+	nested := ""
 	for {
 		header, err := reader.Next()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return nil, err
+			return nil, "", "", classifyRarError(ref, err)
 		}
 		
 		if header.IsDir {
@@ -1207,68 +1579,88 @@ func extractFirstImageFromRar(rarPath string) ([]byte, error) {
 		}
 		
 		ext := strings.ToLower(filepath.Ext(header.Name))
+		if isArchiveFile(ext) && nested == "" {
+			nested = header.Name
+		}
 		if isImageFile(ext) {
-			data, err := io.ReadAll(reader)
+			// サイズの上限を超える画像は読み込まない
+			limit := maxImageBytes()
+			if limit > 0 && !header.UnKnownSize && header.UnPackedSize > limit {
+				return nil, "", "", newImageLimitError(ref.Key()+"/"+header.Name, errImageTooLarge)
+			}
+			data, err := readEntryData(reader, limit)
+			if errors.Is(err, errEntryTooLarge) {
+				return nil, "", "", newImageLimitError(ref.Key()+"/"+header.Name, errImageTooLarge)
+			}
 			if err != nil {
+				if err = classifyRarError(ref, err); isPasswordError(err) {
+					return nil, "", "", err
+				}
 				continue
 			}
 			
-			return data, nil
+			return data, header.Name, "", nil
 		}
 	}
 	
-	return nil, fmt.Errorf("no image found in archive")
+	return nil, "", nested, nil
 }
 
 // アーカイブから指定画像を抽出
-func extractImageFromArchive(archivePath, imageName string) ([]byte, error) {
-	ext := strings.ToLower(filepath.Ext(archivePath))
-	
-	switch ext {
+func extractImageFromArchive(ref archiveRef, imageName string) ([]byte, error) {
+	data, err := extractEntryFromArchive(ref, imageName, maxImageBytes())
+	if errors.Is(err, errEntryTooLarge) {
+		return nil, newImageLimitError(ref.Key()+"/"+imageName, errImageTooLarge)
+	}
+	return data, err
+}
+
+// アーカイブから指定エントリを抽出（maxSizeが0の場合は無制限）
+func extractEntryFromArchive(ref archiveRef, name string, maxSize int64) ([]byte, error) {
+	switch ref.Ext() {
 	case ".zip", ".cbz":
-		return extractSpecificImageFromZip(archivePath, imageName)
+		return extractEntryFromZip(ref, name, maxSize)
 	case ".rar", ".cbr":
-		return extractSpecificImageFromRar(archivePath, imageName)
+		return extractEntryFromRar(ref, name, maxSize)
 	default:
 		return nil, fmt.Errorf("unsupported archive format")
 	}
 }
 
-// ZIPから指定画像を抽出
-func extractSpecificImageFromZip(zipPath, imageName string) ([]byte, error) {
-	reader, err := zip.OpenReader(zipPath)
+// ZIPから指定エントリを抽出
+func extractEntryFromZip(ref archiveRef, name string, maxSize int64) ([]byte, error) {
+	reader, closeReader, err := openZipArchive(ref)
 	if err != nil {
 		return nil, err
 	}
-	defer reader.Close()
+	defer closeReader()
 	
 	for _, file := range reader.File {
-		if file.Name == imageName {
-			rc, err := file.Open()
+		if file.Name == name {
+			if maxSize > 0 && file.UncompressedSize64 > uint64(maxSize) {
+				return nil, errEntryTooLarge
+			}
+			
+			rc, err := openZipEntry(file, archivePassword(ref))
 			if err != nil {
 				return nil, err
 			}
 			defer rc.Close()
 			
-			return io.ReadAll(rc)
+			return readEntryData(rc, maxSize)
 		}
 	}
 	
-	return nil, fmt.Errorf("image not found in ZIP: %s", imageName)
+	return nil, fmt.Errorf("entry not found in ZIP: %s", name)
 }
 
-// RARから指定画像を抽出
-func extractSpecificImageFromRar(rarPath, imageName string) ([]byte, error) {
-	file, err := os.Open(rarPath)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
-	
-	reader, err := rardecode.NewReader(file, "")
+// RARから指定エントリを抽出
+func extractEntryFromRar(ref archiveRef, name string, maxSize int64) ([]byte, error) {
+	reader, closeReader, err := openRarArchive(ref)
 	if err != nil {
 		return nil, err
 	}
+	defer closeReader()
 	
 	for {
 		header, err := reader.Next()
@@ -1276,13 +1668,37 @@ func extractSpecificImageFromRar(rarPath, imageName string) ([]byte, error) {
 			break
 		}
 		if err != nil {
-			return nil, err
+			return nil, classifyRarError(ref, err)
 		}
 		
-		if header.Name == imageName {
-			return io.ReadAll(reader)
+		if header.Name == name {
+			if maxSize > 0 && !header.UnKnownSize && header.UnPackedSize > maxSize {
+				return nil, errEntryTooLarge
+			}
+			
+			data, err := readEntryData(reader, maxSize)
+			if err != nil && err != errEntryTooLarge {
+				return nil, classifyRarError(ref, err)
+			}
+			return data, err
 		}
 	}
 	
-	return nil, fmt.Errorf("image not found in RAR: %s", imageName)
-} 
\ No newline at end of file
+	return nil, fmt.Errorf("entry not found in RAR: %s", name)
+}
+
+// エントリデータを読み込み（宣言サイズが偽装されていても上限を超えて読まない）
+func readEntryData(r io.Reader, maxSize int64) ([]byte, error) {
+	if maxSize <= 0 {
+		return io.ReadAll(r)
+	}
+	
+	data, err := io.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxSize {
+		return nil, errEntryTooLarge
+	}
+	return data, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// MetadataCache アーカイブ・ディレクトリごとの付加情報（ページ情報・ComicInfo.xmlなど）のキャッシュ
+// キーは更新日時を含むため更新前のエントリは参照されなくなる。件数の上限を超えたら最も古く使われたものを削除
+type MetadataCache[V any] struct {
+	entries map[string]*list.Element
+	order   *list.List // 先頭が最近使われたもの
+	mutex   sync.Mutex
+}
+
+type metadataEntry[V any] struct {
+	key   string
+	value V
+}
+
+func newMetadataCache[V any]() *MetadataCache[V] {
+	return &MetadataCache[V]{
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// 保持する件数（cache.metadata_max_size、未設定の場合は1000）
+func metadataCacheMaxSize() int {
+	if config.Cache.MetadataMaxSize > 0 {
+		return config.Cache.MetadataMaxSize
+	}
+	return 1000
+}
+
+// Get キャッシュから取得
+func (mc *MetadataCache[V]) Get(key string) (V, bool) {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+
+	element, found := mc.entries[key]
+	if !found {
+		var zero V
+		return zero, false
+	}
+	mc.order.MoveToFront(element)
+	return element.Value.(*metadataEntry[V]).value, true
+}
+
+// Set キャッシュに保存
+func (mc *MetadataCache[V]) Set(key string, value V) {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+
+	if element, found := mc.entries[key]; found {
+		element.Value.(*metadataEntry[V]).value = value
+		mc.order.MoveToFront(element)
+		return
+	}
+	mc.entries[key] = mc.order.PushFront(&metadataEntry[V]{key: key, value: value})
+	for mc.order.Len() > metadataCacheMaxSize() {
+		oldest := mc.order.Back()
+		mc.order.Remove(oldest)
+		delete(mc.entries, oldest.Value.(*metadataEntry[V]).key)
+	}
+}
+
+// Delete キャッシュから削除
+func (mc *MetadataCache[V]) Delete(key string) {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+
+	if element, found := mc.entries[key]; found {
+		mc.order.Remove(element)
+		delete(mc.entries, key)
+	}
+}
+
+// Len 保持している件数
+func (mc *MetadataCache[V]) Len() int {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+	return mc.order.Len()
+}
@@ -0,0 +1,685 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// OPDSのメディアタイプ・リンクのrel
+const (
+	opdsNavigationType  = "application/atom+xml;profile=opds-catalog;kind=navigation"
+	opdsAcquisitionType = "application/atom+xml;profile=opds-catalog;kind=acquisition"
+	opdsJSONType        = "application/opds+json"
+	openSearchType      = "application/opensearchdescription+xml"
+
+	opdsRelAcquisition = "http://opds-spec.org/acquisition"
+	opdsRelImage       = "http://opds-spec.org/image"
+	opdsRelThumbnail   = "http://opds-spec.org/image/thumbnail"
+)
+
+// OPDSフィードのURLの接頭辞
+const (
+	opdsV1Prefix = "/opds/v1.2"
+	opdsV2Prefix = "/opds/v2"
+)
+
+// 表紙・サムネイル画像のサイズ（サムネイルAPIの上限は500）
+const (
+	opdsCoverSize     = 500
+	opdsThumbnailSize = 200
+)
+
+// catalogEntry カタログの項目（ディレクトリまたはアーカイブ）
+type catalogEntry struct {
+	FileInfo
+	ModTime time.Time
+}
+
+// atomFeed OPDS 1.2（Atom）のフィード
+type atomFeed struct {
+	XMLName         xml.Name    `xml:"feed"`
+	Xmlns           string      `xml:"xmlns,attr"`
+	XmlnsOpenSearch string      `xml:"xmlns:opensearch,attr"`
+	XmlnsPSE        string      `xml:"xmlns:pse,attr"`
+	ID              string      `xml:"id"`
+	Title           string      `xml:"title"`
+	Updated         string      `xml:"updated"`
+	Author          atomAuthor  `xml:"author"`
+	TotalResults    int         `xml:"opensearch:totalResults,omitempty"`
+	ItemsPerPage    int         `xml:"opensearch:itemsPerPage,omitempty"`
+	Links           []atomLink  `xml:"link"`
+	Entries         []atomEntry `xml:"entry"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomLink struct {
+	Rel   string `xml:"rel,attr,omitempty"`
+	Href  string `xml:"href,attr"`
+	Type  string `xml:"type,attr,omitempty"`
+	Title string `xml:"title,attr,omitempty"`
+	Count int    `xml:"pse:count,attr,omitempty"` // OPDS-PSEのページ数
+}
+
+type atomEntry struct {
+	Title   string       `xml:"title"`
+	ID      string       `xml:"id"`
+	Updated string       `xml:"updated"`
+	Content *atomContent `xml:"content,omitempty"`
+	Links   []atomLink   `xml:"link"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Text string `xml:",chardata"`
+}
+
+// ディレクトリ直下のサブディレクトリとアーカイブ（単体の画像ファイルは含めない）
+func catalogEntries(relPath string) ([]catalogEntry, error) {
+	dirPath := filepath.Join(config.Manga.SourcePath, relPath)
+	files, err := scanFiles(dirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []catalogEntry
+	for _, file := range files {
+		ext := strings.ToLower(file.Extension)
+		if !file.IsDir && !isArchiveFile(ext) {
+			continue
+		}
+		file.IsArchive = !file.IsDir
+		file.Path = strings.TrimPrefix(path.Join(filepath.ToSlash(relPath), file.Name), "/")
+		entry := catalogEntry{FileInfo: file}
+		if info, err := os.Stat(filepath.Join(dirPath, file.Name)); err == nil {
+			entry.ModTime = info.ModTime()
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// catalogIndex 検索用の索引（ライブラリ全体のディレクトリ・アーカイブ、浅い階層から順）
+type catalogIndex struct {
+	entries []catalogEntry
+	built   time.Time
+	mutex   sync.Mutex
+}
+
+var searchIndex catalogIndex
+
+// 索引を取得（search_index_minutes を過ぎていれば作り直す）
+func (idx *catalogIndex) get() ([]catalogEntry, error) {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
+	ttl := time.Duration(config.OPDS.SearchIndexMinutes) * time.Minute
+	if idx.entries != nil && time.Since(idx.built) < ttl {
+		return idx.entries, nil
+	}
+
+	start := time.Now()
+	entries := []catalogEntry{}
+	queue := []string{""}
+	for len(queue) > 0 {
+		dir := queue[0]
+		queue = queue[1:]
+		children, err := catalogEntries(dir)
+		if err != nil {
+			if dir == "" {
+				return nil, err
+			}
+			continue
+		}
+		for _, entry := range children {
+			if entry.IsDir {
+				queue = append(queue, entry.Path)
+			}
+			entries = append(entries, entry)
+		}
+	}
+	idx.entries, idx.built = entries, time.Now()
+	log.Printf("OPDS search index built - entries: %d, elapsed: %v", len(entries), time.Since(start))
+	return entries, nil
+}
+
+// 名前に検索語をすべて含むディレクトリ・アーカイブ（索引から検索）
+func searchCatalog(query string) ([]catalogEntry, error) {
+	terms := strings.Fields(strings.ToLower(query))
+	if len(terms) == 0 {
+		return nil, nil
+	}
+
+	entries, err := searchIndex.get()
+	if err != nil {
+		return nil, err
+	}
+	var results []catalogEntry
+	for _, entry := range entries {
+		if matchesAllTerms(strings.ToLower(entry.Name), terms) {
+			results = append(results, entry)
+		}
+	}
+	return results, nil
+}
+
+func matchesAllTerms(name string, terms []string) bool {
+	for _, term := range terms {
+		if !strings.Contains(name, term) {
+			return false
+		}
+	}
+	return true
+}
+
+// 1ページあたりの項目数
+func opdsPageSize() int {
+	if config.OPDS.PageSize > 0 {
+		return config.OPDS.PageSize
+	}
+	return 100
+}
+
+// ページ番号（page= クエリ、1から）で項目を切り出す
+func paginateCatalog(entries []catalogEntry, page int) []catalogEntry {
+	start := (page - 1) * opdsPageSize()
+	if start >= len(entries) {
+		return nil
+	}
+	end := start + opdsPageSize()
+	if end > len(entries) {
+		end = len(entries)
+	}
+	return entries[start:end]
+}
+
+// ページ数（項目がなくても1）
+func catalogPageCount(total int) int {
+	if total == 0 {
+		return 1
+	}
+	return (total + opdsPageSize() - 1) / opdsPageSize()
+}
+
+func opdsPage(c *gin.Context) int {
+	page, err := strconv.Atoi(c.Query("page"))
+	if err != nil || page < 1 {
+		return 1
+	}
+	return page
+}
+
+// リクエストパスからカタログのパスを取得
+// OPDSのリンクはパスとしてエスケープするため、デコード済みのパスをさらにデコードしない（+ などを含む名前のため）
+func catalogRequestPath(c *gin.Context) string {
+	return strings.Trim(c.Param("path"), "/")
+}
+
+// パスの各要素をエスケープ（OPDSのハンドラーへのリンク）
+func escapeCatalogPath(relPath string) string {
+	segments := strings.Split(relPath, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// カタログのディレクトリを確認（存在しない場合はレスポンスを書き込んでfalse）
+func catalogDirectory(c *gin.Context, relPath string) (os.FileInfo, bool) {
+	info, err := os.Stat(filepath.Join(config.Manga.SourcePath, relPath))
+	if err != nil || !info.IsDir() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Directory not found", "path": relPath})
+		return nil, false
+	}
+	return info, true
+}
+
+// フィードのタイトル（ルートは設定のタイトル）
+func catalogTitle(relPath string) string {
+	if relPath == "" {
+		return config.OPDS.Title
+	}
+	return path.Base(relPath)
+}
+
+func catalogURL(prefix, relPath string) string {
+	return prefix + "/catalog/" + escapeCatalogPath(relPath)
+}
+
+func catalogPageURL(prefix, relPath string, page int) string {
+	if page <= 1 {
+		return catalogURL(prefix, relPath)
+	}
+	return catalogURL(prefix, relPath) + "?page=" + strconv.Itoa(page)
+}
+
+func catalogEntryID(relPath string) string {
+	return "urn:manga-server:" + (&url.URL{Path: relPath}).EscapedPath()
+}
+
+// 表紙画像を取得できるか（ディレクトリは直下に画像がある場合のみ）
+func catalogHasCover(entry catalogEntry) bool {
+	if entry.IsArchive {
+		return true
+	}
+	_, err := findFirstImage(filepath.Join(config.Manga.SourcePath, entry.Path))
+	return err == nil
+}
+
+// 表紙・サムネイルのURL（サムネイルAPIでJPEGに変換）
+// サムネイルAPIはデコード済みのパスをさらにQueryUnescapeするため、クエリ形式でエスケープした上でパスとしてエスケープする
+func catalogCoverURL(relPath string, size int) string {
+	return "/api/v1/thumbnail/" + url.PathEscape(url.QueryEscape(relPath)) + "?size=" + strconv.Itoa(size) + "&format=jpeg"
+}
+
+// アーカイブのダウンロードURL（分割RARは1ファイルとして取得できないため空）
+func catalogDownloadURL(entry catalogEntry) string {
+	if !entry.IsArchive || entry.Volumes > 1 {
+		return ""
+	}
+	return "/api/v1/download/" + escapeCatalogPath(entry.Path)
+}
+
+// アーカイブのメディアタイプ
+func archiveMediaType(ext string) string {
+	switch strings.ToLower(ext) {
+	case ".cbz":
+		return "application/vnd.comicbook+zip"
+	case ".cbr":
+		return "application/vnd.comicbook-rar"
+	case ".zip":
+		return "application/zip"
+	case ".rar":
+		return "application/vnd.rar"
+	}
+	return "application/octet-stream"
+}
+
+// 項目の説明（形式・サイズ・ボリューム数）
+func catalogSummary(entry catalogEntry) string {
+	if entry.IsDir {
+		return ""
+	}
+	summary := fmt.Sprintf("%s, %.1f MB", strings.ToUpper(strings.TrimPrefix(entry.Extension, ".")), float64(entry.Size)/1024/1024)
+	if entry.Volumes > 1 {
+		summary += fmt.Sprintf(", %d volumes", entry.Volumes)
+	}
+	return summary
+}
+
+// フィードの更新日時（項目の最新の更新日時）
+func catalogUpdated(entries []catalogEntry, fallback time.Time) time.Time {
+	updated := fallback
+	for _, entry := range entries {
+		if entry.ModTime.After(updated) {
+			updated = entry.ModTime
+		}
+	}
+	return updated
+}
+
+func atomTime(t time.Time) string {
+	if t.IsZero() {
+		t = time.Now()
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// リクエストのスキームとホスト（OpenSearchのテンプレートは絶対URLが必要）
+func requestBaseURL(c *gin.Context) string {
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	if proto := c.GetHeader("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + c.Request.Host
+}
+
+// OPDS 1.2の項目
+func atomCatalogEntry(entry catalogEntry) atomEntry {
+	item := atomEntry{
+		Title:   entry.Name,
+		ID:      catalogEntryID(entry.Path),
+		Updated: atomTime(entry.ModTime),
+	}
+	if summary := catalogSummary(entry); summary != "" {
+		item.Content = &atomContent{Type: "text", Text: summary}
+	}
+
+	if entry.IsDir {
+		item.Links = append(item.Links, atomLink{Rel: "subsection", Href: catalogURL(opdsV1Prefix, entry.Path), Type: opdsNavigationType})
+	} else if download := catalogDownloadURL(entry); download != "" {
+		item.Links = append(item.Links, atomLink{Rel: opdsRelAcquisition, Href: download, Type: archiveMediaType(entry.Extension)})
+	}
+	// ページ単位の配信（アーカイブ、画像を直接含むディレクトリ）
+	if count := streamPageCount(entry); count > 0 {
+		item.Links = append(item.Links, atomLink{Rel: opdsRelPSEStream, Href: streamURLTemplate(entry.Path), Type: "image/jpeg", Count: count})
+	}
+	if catalogHasCover(entry) {
+		item.Links = append(item.Links,
+			atomLink{Rel: opdsRelImage, Href: catalogCoverURL(entry.Path, opdsCoverSize), Type: "image/jpeg"},
+			atomLink{Rel: opdsRelThumbnail, Href: catalogCoverURL(entry.Path, opdsThumbnailSize), Type: "image/jpeg"},
+		)
+	}
+	return item
+}
+
+// OPDS 1.2のフィードを生成（アーカイブを含む場合はacquisition、ディレクトリのみの場合はnavigation）
+func atomCatalogFeed(id, title string, entries []catalogEntry, updated time.Time) (*atomFeed, string) {
+	feed := &atomFeed{
+		Xmlns:           "http://www.w3.org/2005/Atom",
+		XmlnsOpenSearch: "http://a9.com/-/spec/opensearch/1.1/",
+		XmlnsPSE:        opdsPSENamespace,
+		ID:              id,
+		Title:           title,
+		Updated:         atomTime(updated),
+		Author:          atomAuthor{Name: config.OPDS.Title},
+	}
+	kind := opdsNavigationType
+	for _, entry := range entries {
+		if entry.IsArchive {
+			kind = opdsAcquisitionType
+		}
+		feed.Entries = append(feed.Entries, atomCatalogEntry(entry))
+	}
+	return feed, kind
+}
+
+// 共通のリンク（開始・検索）
+func atomCommonLinks() []atomLink {
+	return []atomLink{
+		{Rel: "start", Href: catalogURL(opdsV1Prefix, ""), Type: opdsNavigationType, Title: config.OPDS.Title},
+		{Rel: "search", Href: opdsV1Prefix + "/opensearch.xml", Type: openSearchType},
+	}
+}
+
+func writeAtomFeed(c *gin.Context, feed *atomFeed, kind string) {
+	data, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Data(http.StatusOK, kind+";charset=utf-8", append([]byte(xml.Header), data...))
+}
+
+// OPDS 1.2のカタログ（ディレクトリごとのフィード）
+func opdsCatalog(c *gin.Context) {
+	relPath := catalogRequestPath(c)
+	info, ok := catalogDirectory(c, relPath)
+	if !ok {
+		return
+	}
+	entries, err := catalogEntries(relPath)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan files: " + err.Error()})
+		return
+	}
+
+	page := opdsPage(c)
+	pages := catalogPageCount(len(entries))
+	feed, kind := atomCatalogFeed(catalogEntryID("catalog:"+relPath), catalogTitle(relPath),
+		paginateCatalog(entries, page), catalogUpdated(entries, info.ModTime()))
+	feed.TotalResults = len(entries)
+	feed.ItemsPerPage = opdsPageSize()
+
+	feed.Links = append(feed.Links, atomLink{Rel: "self", Href: catalogPageURL(opdsV1Prefix, relPath, page), Type: kind})
+	feed.Links = append(feed.Links, atomCommonLinks()...)
+	if relPath != "" {
+		feed.Links = append(feed.Links, atomLink{Rel: "up", Href: catalogURL(opdsV1Prefix, parentCatalogPath(relPath)), Type: opdsNavigationType})
+	}
+	if page > 1 {
+		feed.Links = append(feed.Links,
+			atomLink{Rel: "first", Href: catalogPageURL(opdsV1Prefix, relPath, 1), Type: kind},
+			atomLink{Rel: "previous", Href: catalogPageURL(opdsV1Prefix, relPath, page-1), Type: kind},
+		)
+	}
+	if page < pages {
+		feed.Links = append(feed.Links,
+			atomLink{Rel: "next", Href: catalogPageURL(opdsV1Prefix, relPath, page+1), Type: kind},
+			atomLink{Rel: "last", Href: catalogPageURL(opdsV1Prefix, relPath, pages), Type: kind},
+		)
+	}
+	writeAtomFeed(c, feed, kind)
+}
+
+func parentCatalogPath(relPath string) string {
+	parent := path.Dir(relPath)
+	if parent == "." {
+		return ""
+	}
+	return parent
+}
+
+// 検索結果のページのURL
+func searchPageURL(prefix, param, query string, page int) string {
+	searchURL := prefix + "/search?" + param + "=" + url.QueryEscape(query)
+	if page > 1 {
+		searchURL += "&page=" + strconv.Itoa(page)
+	}
+	return searchURL
+}
+
+// OPDS 1.2の検索結果
+func opdsSearch(c *gin.Context) {
+	query := c.Query("q")
+	results, err := searchCatalog(query)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search: " + err.Error()})
+		return
+	}
+
+	page := opdsPage(c)
+	pages := catalogPageCount(len(results))
+	feed, _ := atomCatalogFeed(catalogEntryID("search:"+query), "Search: "+query, paginateCatalog(results, page), time.Time{})
+	feed.TotalResults = len(results)
+	feed.ItemsPerPage = opdsPageSize()
+	feed.Links = append(feed.Links, atomLink{Rel: "self", Href: searchPageURL(opdsV1Prefix, "q", query, page), Type: opdsAcquisitionType})
+	feed.Links = append(feed.Links, atomCommonLinks()...)
+	if page > 1 {
+		feed.Links = append(feed.Links,
+			atomLink{Rel: "first", Href: searchPageURL(opdsV1Prefix, "q", query, 1), Type: opdsAcquisitionType},
+			atomLink{Rel: "previous", Href: searchPageURL(opdsV1Prefix, "q", query, page-1), Type: opdsAcquisitionType},
+		)
+	}
+	if page < pages {
+		feed.Links = append(feed.Links,
+			atomLink{Rel: "next", Href: searchPageURL(opdsV1Prefix, "q", query, page+1), Type: opdsAcquisitionType},
+			atomLink{Rel: "last", Href: searchPageURL(opdsV1Prefix, "q", query, pages), Type: opdsAcquisitionType},
+		)
+	}
+	writeAtomFeed(c, feed, opdsAcquisitionType)
+}
+
+// OpenSearchの定義
+func opdsOpenSearch(c *gin.Context) {
+	type openSearchURL struct {
+		Type     string `xml:"type,attr"`
+		Template string `xml:"template,attr"`
+	}
+	description := struct {
+		XMLName        xml.Name      `xml:"OpenSearchDescription"`
+		Xmlns          string        `xml:"xmlns,attr"`
+		ShortName      string        `xml:"ShortName"`
+		Description    string        `xml:"Description"`
+		InputEncoding  string        `xml:"InputEncoding"`
+		OutputEncoding string        `xml:"OutputEncoding"`
+		URL            openSearchURL `xml:"Url"`
+	}{
+		Xmlns:          "http://a9.com/-/spec/opensearch/1.1/",
+		ShortName:      config.OPDS.Title,
+		Description:    "Search directories and archives by name",
+		InputEncoding:  "UTF-8",
+		OutputEncoding: "UTF-8",
+		URL: openSearchURL{
+			Type:     opdsAcquisitionType,
+			Template: requestBaseURL(c) + opdsV1Prefix + "/search?q={searchTerms}",
+		},
+	}
+
+	data, err := xml.MarshalIndent(description, "", "  ")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Data(http.StatusOK, openSearchType+";charset=utf-8", append([]byte(xml.Header), data...))
+}
+
+// OPDS 2.0の出版物（アーカイブ）
+func opds2Publication(entry catalogEntry) gin.H {
+	links := []gin.H{}
+	if download := catalogDownloadURL(entry); download != "" {
+		links = append(links, gin.H{"rel": opdsRelAcquisition, "href": download, "type": archiveMediaType(entry.Extension)})
+	}
+	publication := gin.H{
+		"metadata": gin.H{
+			"@type":       "http://schema.org/Book",
+			"identifier":  catalogEntryID(entry.Path),
+			"title":       entry.Name,
+			"modified":    atomTime(entry.ModTime),
+			"description": catalogSummary(entry),
+		},
+		"links": links,
+	}
+	if catalogHasCover(entry) {
+		publication["images"] = []gin.H{
+			{"href": catalogCoverURL(entry.Path, opdsCoverSize), "type": "image/jpeg", "width": opdsCoverSize},
+			{"href": catalogCoverURL(entry.Path, opdsThumbnailSize), "type": "image/jpeg", "width": opdsThumbnailSize},
+		}
+	}
+	return publication
+}
+
+// OPDS 2.0のフィード（ディレクトリはnavigation、アーカイブはpublications）
+func opds2Feed(title string, entries []catalogEntry, links []gin.H) gin.H {
+	navigation := []gin.H{}
+	publications := []gin.H{}
+	for _, entry := range entries {
+		if entry.IsDir {
+			navigation = append(navigation, gin.H{
+				"href":  catalogURL(opdsV2Prefix, entry.Path),
+				"title": entry.Name,
+				"type":  opdsJSONType,
+				"rel":   "subsection",
+			})
+			continue
+		}
+		publications = append(publications, opds2Publication(entry))
+	}
+
+	links = append(links,
+		gin.H{"rel": "start", "href": catalogURL(opdsV2Prefix, ""), "type": opdsJSONType},
+		gin.H{"rel": "search", "href": opdsV2Prefix + "/search{?query}", "type": opdsJSONType, "templated": true},
+	)
+	feed := gin.H{
+		"metadata": gin.H{"title": title},
+		"links":    links,
+	}
+	// 空のコレクションは含めない（どちらもない場合はnavigationを空で返す）
+	if len(navigation) > 0 || len(publications) == 0 {
+		feed["navigation"] = navigation
+	}
+	if len(publications) > 0 {
+		feed["publications"] = publications
+	}
+	return feed
+}
+
+// OPDS 2.0のカタログ
+func opds2Catalog(c *gin.Context) {
+	relPath := catalogRequestPath(c)
+	if _, ok := catalogDirectory(c, relPath); !ok {
+		return
+	}
+	entries, err := catalogEntries(relPath)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan files: " + err.Error()})
+		return
+	}
+
+	page := opdsPage(c)
+	pages := catalogPageCount(len(entries))
+	links := []gin.H{{"rel": "self", "href": catalogPageURL(opdsV2Prefix, relPath, page), "type": opdsJSONType}}
+	if relPath != "" {
+		links = append(links, gin.H{"rel": "up", "href": catalogURL(opdsV2Prefix, parentCatalogPath(relPath)), "type": opdsJSONType})
+	}
+	if page > 1 {
+		links = append(links, gin.H{"rel": "previous", "href": catalogPageURL(opdsV2Prefix, relPath, page-1), "type": opdsJSONType})
+	}
+	if page < pages {
+		links = append(links, gin.H{"rel": "next", "href": catalogPageURL(opdsV2Prefix, relPath, page+1), "type": opdsJSONType})
+	}
+
+	feed := opds2Feed(catalogTitle(relPath), paginateCatalog(entries, page), links)
+	metadata := feed["metadata"].(gin.H)
+	metadata["numberOfItems"] = len(entries)
+	metadata["itemsPerPage"] = opdsPageSize()
+	metadata["currentPage"] = page
+	writeOPDS2Feed(c, feed)
+}
+
+// OPDS 2.0の検索結果
+func opds2Search(c *gin.Context) {
+	query := c.Query("query")
+	results, err := searchCatalog(query)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search: " + err.Error()})
+		return
+	}
+
+	page := opdsPage(c)
+	pages := catalogPageCount(len(results))
+	links := []gin.H{{"rel": "self", "href": searchPageURL(opdsV2Prefix, "query", query, page), "type": opdsJSONType}}
+	if page > 1 {
+		links = append(links, gin.H{"rel": "previous", "href": searchPageURL(opdsV2Prefix, "query", query, page-1), "type": opdsJSONType})
+	}
+	if page < pages {
+		links = append(links, gin.H{"rel": "next", "href": searchPageURL(opdsV2Prefix, "query", query, page+1), "type": opdsJSONType})
+	}
+
+	feed := opds2Feed("Search: "+query, paginateCatalog(results, page), links)
+	metadata := feed["metadata"].(gin.H)
+	metadata["numberOfItems"] = len(results)
+	metadata["itemsPerPage"] = opdsPageSize()
+	metadata["currentPage"] = page
+	writeOPDS2Feed(c, feed)
+}
+
+func writeOPDS2Feed(c *gin.Context, feed gin.H) {
+	c.Header("Content-Type", opdsJSONType)
+	c.JSON(http.StatusOK, feed)
+}
+
+// アーカイブファイルのダウンロード（Range・条件付きリクエストに対応）
+func downloadArchive(c *gin.Context) {
+	relPath := catalogRequestPath(c)
+	fullPath := filepath.Join(config.Manga.SourcePath, relPath)
+	info, err := os.Stat(fullPath)
+	if err != nil || info.IsDir() || !isArchiveFile(strings.ToLower(filepath.Ext(fullPath))) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Archive not found", "path": relPath})
+		return
+	}
+
+	validator := newImageValidator(fileSourceKey(fullPath), fullPath)
+	if respondNotModified(c, validator) {
+		return
+	}
+	c.Header("Content-Type", archiveMediaType(filepath.Ext(fullPath)))
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename*=UTF-8''%s", url.PathEscape(info.Name())))
+	serveImageFile(c, fullPath, validator)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// OPDS-PSE（Page Streaming Extension）の名前空間とリンクのrel
+const (
+	opdsPSENamespace = "http://vaemendis.net/opds-pse/ns"
+	opdsRelPSEStream = "http://vaemendis.net/opds-pse/stream"
+)
+
+// アーカイブのページ数のキャッシュ（キーはアーカイブと更新日時）
+var streamPageCountCache = newMetadataCache[int]()
+
+// ページ単位で配信できるページ数（アーカイブ内の画像、ディレクトリ直下の画像）
+// 読み込めない場合（パスワード付きなど）は0
+func streamPageCount(entry catalogEntry) int {
+	if entry.IsDir {
+		return len(directoryImageNames(filepath.Join(config.Manga.SourcePath, entry.Path)))
+	}
+
+	ref, _, err := splitArchivePath(entry.Path)
+	if err != nil {
+		return 0
+	}
+	cacheKey := versionedCacheKey(ref.Key(), ref.DiskPath)
+	if count, found := streamPageCountCache.Get(cacheKey); found {
+		return count
+	}
+
+	files, err := listArchiveFiles(ref)
+	if err != nil {
+		return 0
+	}
+	count := len(sortedArchivePages(files))
+	streamPageCountCache.Set(cacheKey, count)
+	return count
+}
+
+// ディレクトリ直下の画像ファイル名（ページ一覧と同じ順序）
+func directoryImageNames(dirPath string) []string {
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && isImageFile(strings.ToLower(filepath.Ext(entry.Name()))) {
+			names = append(names, entry.Name())
+		}
+	}
+	return names
+}
+
+// ページ配信URLのテンプレート（{pageNumber}は0から、{maxWidth}はクライアントの表示幅）
+func streamURLTemplate(relPath string) string {
+	return "/opds/pse/" + escapeCatalogPath(relPath) + "?page={pageNumber}&max_width={maxWidth}"
+}
+
+// OPDS-PSEのページ配信（ページ番号の画像を画像APIと同じ処理で配信）
+func serveStreamPage(c *gin.Context) {
+	// 画像APIに渡すクエリを書き換えるため、c.Queryは使わずに読み取る
+	query := c.Request.URL.Query()
+	page, err := strconv.Atoi(query.Get("page"))
+	if err != nil || page < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid page number"})
+		return
+	}
+
+	src, ok := pageSourceForPath(c, catalogRequestPath(c))
+	if !ok {
+		return
+	}
+	if page >= len(src.entries) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Page not found", "page": page, "count": len(src.entries)})
+		return
+	}
+	entry := src.entries[page]
+
+	// リンクで示したimage/jpegで配信（JPEGのページは変換しない、WebPはデコードできないため元の形式のまま）
+	switch strings.ToLower(filepath.Ext(entry)) {
+	case ".png", ".gif":
+		if query.Get("format") == "" {
+			query.Set("format", "jpeg")
+			c.Request.URL.RawQuery = query.Encode()
+		}
+	}
+
+	// パスを書き換えて画像APIの処理に渡す（QueryUnescapeで元に戻るようエスケープ）
+	// max_width= などのクエリはそのまま画像APIの変換オプションになる
+	for i := range c.Params {
+		if c.Params[i].Key == "path" {
+			c.Params[i].Value = "/" + url.QueryEscape(src.pageKey(entry))
+		}
+	}
+	if src.isArchive {
+		serveArchiveImage(c)
+		return
+	}
+	serveImage(c)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"image"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"github.com/gin-gonic/gin"
+)
+
+// ページごとの回転（時計回りの角度、キーはライブラリからの相対パス、アーカイブ内はアーカイブのパスを含む）
+var pageRotationStore *JSONStore[int]
+
+// ページ回転の初期化
+func initPageRotationStore() {
+	pageRotationStore = newJSONStore[int](config.Rotation.RotationsFile)
+	if err := pageRotationStore.load(); err != nil && !os.IsNotExist(err) {
+		log.Printf("Warning: Could not load page rotations file: %v", err)
+	}
+	log.Printf("Page rotation store initialized - entries: %d", pageRotationStore.Len())
+}
+
+// 回転角度を0・90・180・270に正規化（90の倍数でない場合はfalse）
+func normalizeRotation(rotation int) (int, bool) {
+	if rotation%90 != 0 {
+		return 0, false
+	}
+	return (rotation%360 + 360) % 360, true
+}
+
+// 90度・270度の回転で縦横が入れ替わるか
+func rotationSwapsAxes(rotation int) bool {
+	return rotation == 90 || rotation == 270
+}
+
+// 回転後の画像サイズ
+func rotatedConfig(cfg image.Config, rotation int) image.Config {
+	if rotationSwapsAxes(rotation) {
+		cfg.Width, cfg.Height = cfg.Height, cfg.Width
+	}
+	return cfg
+}
+
+// 時計回りに回転（imagingの回転は反時計回り）
+func rotateImage(img image.Image, rotation int) *image.NRGBA {
+	switch rotation {
+	case 90:
+		return imaging.Rotate270(img)
+	case 180:
+		return imaging.Rotate180(img)
+	case 270:
+		return imaging.Rotate90(img)
+	}
+	return imaging.Clone(img)
+}
+
+// width×heightの画像内の範囲を時計回りに回転した位置
+func rotateRect(rect image.Rectangle, width, height, rotation int) image.Rectangle {
+	switch rotation {
+	case 90:
+		return image.Rect(height-rect.Max.Y, rect.Min.X, height-rect.Min.Y, rect.Max.X)
+	case 180:
+		return image.Rect(width-rect.Max.X, height-rect.Max.Y, width-rect.Min.X, height-rect.Min.Y)
+	case 270:
+		return image.Rect(rect.Min.Y, width-rect.Max.X, rect.Max.Y, width-rect.Min.X)
+	}
+	return rect
+}
+
+// JPEGのEXIFのOrientation（1〜8、読み取れない場合は1）
+// 5〜8は縦横が入れ替わる向き
+func jpegOrientation(r io.Reader) int {
+	br := bufio.NewReader(r)
+	soi := make([]byte, 2)
+	if _, err := io.ReadFull(br, soi); err != nil || soi[0] != 0xff || soi[1] != 0xd8 {
+		return 1
+	}
+
+	for {
+		marker := make([]byte, 4)
+		if _, err := io.ReadFull(br, marker); err != nil || marker[0] != 0xff {
+			return 1
+		}
+		// 画像データ（SOS）以降にはEXIFはない
+		if marker[1] == 0xda || marker[1] == 0xd9 {
+			return 1
+		}
+		length := int(binary.BigEndian.Uint16(marker[2:4])) - 2
+		if length < 0 {
+			return 1
+		}
+		if marker[1] != 0xe1 {
+			if _, err := br.Discard(length); err != nil {
+				return 1
+			}
+			continue
+		}
+
+		segment := make([]byte, length)
+		if _, err := io.ReadFull(br, segment); err != nil {
+			return 1
+		}
+		if bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+	}
+}
+
+// TIFF形式のEXIFからIFD0のOrientationを読み取る
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[0:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	offset := int(order.Uint32(tiff[4:8]))
+	if offset < 8 || offset+2 > len(tiff) {
+		return 1
+	}
+	count := int(order.Uint16(tiff[offset : offset+2]))
+	for i := 0; i < count; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:entry+2]) == 0x0112 {
+			orientation := int(order.Uint16(tiff[entry+8 : entry+10]))
+			if orientation < 1 || orientation > 8 {
+				return 1
+			}
+			return orientation
+		}
+	}
+	return 1
+}
+
+// EXIFで向き（回転・反転）が指定されたJPEGか
+// EXIFを解釈しないクライアントがあるため、元画像のままではなく向きを反映して変換してから配信する
+func hasEXIFOrientation(data []byte) bool {
+	return jpegOrientation(bytes.NewReader(data)) != 1
+}
+
+// EXIFで向きが指定されたJPEGファイルか
+func fileHasEXIFOrientation(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	return jpegOrientation(file) != 1
+}
+
+// EXIFの向きを反映した画像サイズ
+func orientedConfig(cfg image.Config, orientation int) image.Config {
+	if orientation >= 5 {
+		cfg.Width, cfg.Height = cfg.Height, cfg.Width
+	}
+	return cfg
+}
+
+// ページ回転の取得API
+func getPageRotation(c *gin.Context) {
+	decodedPath := rotationRequestPath(c)
+	c.JSON(http.StatusOK, gin.H{
+		"path":     decodedPath,
+		"rotation": pageRotationStore.Get(decodedPath),
+	})
+}
+
+// ページ回転の保存API
+func setPageRotation(c *gin.Context) {
+	decodedPath := rotationRequestPath(c)
+	if decodedPath == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid path format"})
+		return
+	}
+
+	var body struct {
+		Rotation int `json:"rotation"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body: " + err.Error()})
+		return
+	}
+	rotation, ok := normalizeRotation(body.Rotation)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Rotation must be a multiple of 90"})
+		return
+	}
+
+	if err := pageRotationStore.Set(decodedPath, rotation); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save page rotation: " + err.Error()})
+		return
+	}
+
+	log.Printf("Page rotation for %s set to %d", decodedPath, rotation)
+	c.JSON(http.StatusOK, gin.H{
+		"path":     decodedPath,
+		"rotation": rotation,
+	})
+}
+
+func rotationRequestPath(c *gin.Context) string {
+	requestPath := c.Param("path")
+
+	// URLデコード処理
+	decodedPath, err := url.QueryUnescape(requestPath)
+	if err != nil {
+		decodedPath = requestPath
+	}
+	return strings.Trim(decodedPath, "/")
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PageMeta ページ画像のヘッダーから読み取った情報
+type PageMeta struct {
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	Format   string `json:"format"`
+	Animated bool   `json:"animated"`
+}
+
+// Orientation 縦長・横長・正方形
+func (m PageMeta) Orientation() string {
+	switch {
+	case m.Width <= 0 || m.Height <= 0:
+		return ""
+	case m.Width > m.Height:
+		return "landscape"
+	case m.Width < m.Height:
+		return "portrait"
+	}
+	return "square"
+}
+
+// Config 画像サイズとして取得
+func (m PageMeta) Config() image.Config {
+	return image.Config{Width: m.Width, Height: m.Height}
+}
+
+// ページ情報のインデックス（キーはアーカイブ・ディレクトリと更新日時）
+var pageMetaCache = newMetadataCache[map[string]PageMeta]()
+
+// キャッシュ済みのページ情報を取得し、なければloadで読み込んで保存
+func cachedPageMeta(cacheKey string, load func() (map[string]PageMeta, error)) (map[string]PageMeta, error) {
+	if metas, found := pageMetaCache.Get(cacheKey); found {
+		return metas, nil
+	}
+
+	metas, err := load()
+	if err != nil {
+		return nil, err
+	}
+	pageMetaCache.Set(cacheKey, metas)
+	return metas, nil
+}
+
+// ページ情報から画像サイズのみを取り出す
+func pageSizesFromMeta(metas map[string]PageMeta) map[string]image.Config {
+	sizes := make(map[string]image.Config, len(metas))
+	for name, meta := range metas {
+		sizes[name] = meta.Config()
+	}
+	return sizes
+}
+
+// アーカイブ内の各画像のサイズ（キーはエントリパス）
+func archivePageSizes(ref archiveRef) (map[string]image.Config, error) {
+	metas, err := archivePageMeta(ref)
+	if err != nil {
+		return nil, err
+	}
+	return pageSizesFromMeta(metas), nil
+}
+
+// ディレクトリ内の各画像のサイズ（キーはファイル名）
+func directoryPageSizes(dirPath string) (map[string]image.Config, error) {
+	metas, err := directoryPageMeta(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	return pageSizesFromMeta(metas), nil
+}
+
+// アーカイブ内の各画像の情報（ヘッダーのみ読み込み、キーはエントリパス）
+func archivePageMeta(ref archiveRef) (map[string]PageMeta, error) {
+	cacheKey := versionedCacheKey(ref.Key(), ref.DiskPath)
+	return cachedPageMeta(cacheKey, func() (map[string]PageMeta, error) {
+		switch ref.Ext() {
+		case ".zip", ".cbz":
+			return zipPageMeta(ref)
+		case ".rar", ".cbr":
+			return rarPageMeta(ref)
+		}
+		return nil, errNotArchive
+	})
+}
+
+func zipPageMeta(ref archiveRef) (map[string]PageMeta, error) {
+	reader, closeReader, err := openZipArchive(ref)
+	if err != nil {
+		return nil, err
+	}
+	defer closeReader()
+
+	password := archivePassword(ref)
+	metas := make(map[string]PageMeta)
+	for _, file := range reader.File {
+		if file.FileInfo().IsDir() || !isImageFile(strings.ToLower(filepath.Ext(file.Name))) {
+			continue
+		}
+
+		rc, err := openZipEntry(file, password)
+		if err != nil {
+			if isPasswordError(err) {
+				return nil, err
+			}
+			continue
+		}
+		if meta, ok := readPageMeta(rc); ok {
+			metas[file.Name] = meta
+		}
+		rc.Close()
+	}
+	return metas, nil
+}
+
+func rarPageMeta(ref archiveRef) (map[string]PageMeta, error) {
+	reader, closeReader, err := openRarArchive(ref)
+	if err != nil {
+		return nil, err
+	}
+	defer closeReader()
+
+	metas := make(map[string]PageMeta)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, classifyRarError(ref, err)
+		}
+		if header.IsDir || !isImageFile(strings.ToLower(filepath.Ext(header.Name))) {
+			continue
+		}
+		if meta, ok := readPageMeta(reader); ok {
+			metas[header.Name] = meta
+		}
+	}
+	return metas, nil
+}
+
+// ディレクトリ内の各画像の情報（キーはファイル名）
+func directoryPageMeta(dirPath string) (map[string]PageMeta, error) {
+	cacheKey := versionedCacheKey(dirPath, dirPath)
+	return cachedPageMeta(cacheKey, func() (map[string]PageMeta, error) {
+		entries, err := os.ReadDir(dirPath)
+		if err != nil {
+			return nil, err
+		}
+
+		metas := make(map[string]PageMeta)
+		for _, entry := range entries {
+			if entry.IsDir() || !isImageFile(strings.ToLower(filepath.Ext(entry.Name()))) {
+				continue
+			}
+			file, err := os.Open(filepath.Join(dirPath, entry.Name()))
+			if err != nil {
+				continue
+			}
+			if meta, ok := readPageMeta(file); ok {
+				metas[entry.Name()] = meta
+			}
+			file.Close()
+		}
+		return metas, nil
+	})
+}
+
+// meta=true が指定されているか
+func pageMetaRequested(c *gin.Context) bool {
+	requested, _ := strconv.ParseBool(c.Query("meta"))
+	return requested
+}
+
+// 一覧の各画像にページ情報を設定（キーはアーカイブ内のパス、またはディレクトリ内のファイル名）
+func attachPageMeta(files []FileInfo, metas map[string]PageMeta) {
+	for i := range files {
+		if files[i].IsDir || files[i].IsArchive {
+			continue
+		}
+		if meta, found := metas[files[i].Path]; found {
+			files[i].Width = meta.Width
+			files[i].Height = meta.Height
+			files[i].Orientation = meta.Orientation()
+			files[i].Format = meta.Format
+			files[i].Animated = meta.Animated
+		}
+	}
+}
+
+// 画像のヘッダーからサイズ・形式・アニメーションの有無を読み取る
+func readPageMeta(r io.Reader) (PageMeta, bool) {
+	br := bufio.NewReaderSize(r, 4096)
+
+	// WebPは標準のデコーダーがないためヘッダーを直接解析
+	if header, _ := br.Peek(30); len(header) >= 16 && string(header[0:4]) == "RIFF" && string(header[8:12]) == "WEBP" {
+		return webpPageMeta(header)
+	}
+
+	var consumed bytes.Buffer
+	cfg, format, err := image.DecodeConfig(io.TeeReader(br, &consumed))
+	if err != nil {
+		return PageMeta{}, false
+	}
+	meta := PageMeta{Width: cfg.Width, Height: cfg.Height, Format: format}
+
+	// アニメーションの判定は読み込み済みの部分から続けて行う
+	rest := io.MultiReader(&consumed, br)
+	switch format {
+	case "gif":
+		meta.Animated = gifAnimated(rest)
+	case "png":
+		meta.Animated = pngAnimated(rest)
+	case "jpeg":
+		// EXIFで回転する写真は表示時の向きのサイズ
+		if jpegOrientation(rest) >= 5 {
+			meta.Width, meta.Height = meta.Height, meta.Width
+		}
+	}
+	return meta, true
+}
+
+// WebPのヘッダーからサイズとアニメーションの有無を読み取る
+func webpPageMeta(header []byte) (PageMeta, bool) {
+	meta := PageMeta{Format: "webp"}
+	switch string(header[12:16]) {
+	case "VP8X":
+		if len(header) < 30 {
+			return meta, false
+		}
+		meta.Animated = header[20]&0x02 != 0
+		meta.Width = (int(header[24]) | int(header[25])<<8 | int(header[26])<<16) + 1
+		meta.Height = (int(header[27]) | int(header[28])<<8 | int(header[29])<<16) + 1
+	case "VP8 ":
+		if len(header) < 30 {
+			return meta, false
+		}
+		meta.Width = int(binary.LittleEndian.Uint16(header[26:28]) & 0x3fff)
+		meta.Height = int(binary.LittleEndian.Uint16(header[28:30]) & 0x3fff)
+	case "VP8L":
+		if len(header) < 25 {
+			return meta, false
+		}
+		bits := binary.LittleEndian.Uint32(header[21:25])
+		meta.Width = int(bits&0x3fff) + 1
+		meta.Height = int(bits>>14&0x3fff) + 1
+	default:
+		return meta, false
+	}
+	return meta, true
+}
+
+// GIFに2枚以上のフレームがあるか（画素データは読み飛ばす）
+func gifAnimated(r io.Reader) bool {
+	return gifFrameCount(r, 2) > 1
+}
+
+// GIFのフレーム数（limitに達した時点で読み込みを止める、0の場合は最後まで数える）
+func gifFrameCount(r io.Reader, limit int) int {
+	br := bufio.NewReader(r)
+	header := make([]byte, 13)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return 0
+	}
+	// グローバルカラーテーブル
+	if header[10]&0x80 != 0 {
+		if _, err := br.Discard(3 << (int(header[10]&0x07) + 1)); err != nil {
+			return 0
+		}
+	}
+
+	frames := 0
+	for {
+		introducer, err := br.ReadByte()
+		if err != nil {
+			return frames
+		}
+		switch introducer {
+		case 0x21: // 拡張ブロック
+			if _, err := br.ReadByte(); err != nil {
+				return frames
+			}
+		case 0x2c: // イメージブロック
+			frames++
+			if limit > 0 && frames >= limit {
+				return frames
+			}
+			descriptor := make([]byte, 9)
+			if _, err := io.ReadFull(br, descriptor); err != nil {
+				return frames
+			}
+			if descriptor[8]&0x80 != 0 {
+				if _, err := br.Discard(3 << (int(descriptor[8]&0x07) + 1)); err != nil {
+					return frames
+				}
+			}
+			// LZWの最小コードサイズ
+			if _, err := br.ReadByte(); err != nil {
+				return frames
+			}
+		default: // トレーラーまたは不正なデータ
+			return frames
+		}
+		// データサブブロックを読み飛ばす
+		for {
+			size, err := br.ReadByte()
+			if err != nil {
+				return frames
+			}
+			if size == 0 {
+				break
+			}
+			if _, err := br.Discard(int(size)); err != nil {
+				return frames
+			}
+		}
+	}
+}
+
+// PNGがAPNG（画像データより前にacTLチャンクを持つ）か
+func pngAnimated(r io.Reader) bool {
+	br := bufio.NewReader(r)
+	if _, err := br.Discard(8); err != nil {
+		return false
+	}
+	chunk := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(br, chunk); err != nil {
+			return false
+		}
+		switch string(chunk[4:8]) {
+		case "acTL":
+			return true
+		case "IDAT", "IEND":
+			return false
+		}
+		// チャンクデータとCRCを読み飛ばす
+		if _, err := br.Discard(int(binary.BigEndian.Uint32(chunk[0:4])) + 4); err != nil {
+			return false
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"image"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// pageSource ディレクトリまたはアーカイブ（内のフォルダ）の画像ページ一覧
+type pageSource struct {
+	path        string
+	archivePath string // アーカイブの場合はフォルダを除いたパス
+	dirPath     string // ディレクトリの場合のみ
+	ref         archiveRef
+	folder      string
+	isArchive   bool
+	entries     []string // ディレクトリはファイル名、アーカイブはエントリパス
+	allEntries  []string // アーカイブ内のフォルダの場合もアーカイブ全体のページ（ComicInfo.xmlのページ番号に使用）
+}
+
+// ページのパス（ディレクトリの場合はライブラリからの相対パス）
+func (s *pageSource) pagePath(entry string) string {
+	if s.isArchive {
+		return entry
+	}
+	return filepath.ToSlash(filepath.Join(s.path, entry))
+}
+
+// ページごとの設定のキー（ライブラリからの相対パス、アーカイブ内はアーカイブのパスを含む）
+func (s *pageSource) pageKey(entry string) string {
+	if s.isArchive {
+		return s.archivePath + "/" + entry
+	}
+	return s.pagePath(entry)
+}
+
+// ページ画像の配信URL
+func (s *pageSource) imageURL(entry string) string {
+	if s.isArchive {
+		return "/api/v1/archive-image/" + url.QueryEscape(s.archivePath) + "/" + url.QueryEscape(entry)
+	}
+	return "/api/v1/image/" + url.QueryEscape(s.pagePath(entry))
+}
+
+// リクエストパスからページ一覧を取得（失敗時はレスポンスを書き込んでfalse）
+func loadPageSource(c *gin.Context) (*pageSource, bool) {
+	requestPath := c.Param("path")
+
+	// URLデコード処理
+	decodedPath, err := url.QueryUnescape(requestPath)
+	if err != nil {
+		decodedPath = requestPath
+	}
+
+	// 先頭のスラッシュを削除
+	return pageSourceForPath(c, strings.Trim(decodedPath, "/"))
+}
+
+// パス（ライブラリからの相対パス）からページ一覧を取得（失敗時はレスポンスを書き込んでfalse）
+func pageSourceForPath(c *gin.Context, decodedPath string) (*pageSource, bool) {
+	fullPath := filepath.Join(config.Manga.SourcePath, decodedPath)
+	src := &pageSource{path: decodedPath, archivePath: decodedPath}
+
+	if info, statErr := os.Stat(fullPath); statErr == nil && info.IsDir() {
+		// 通常のディレクトリ
+		entries, err := os.ReadDir(fullPath)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return nil, false
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() && isImageFile(strings.ToLower(filepath.Ext(entry.Name()))) {
+				src.entries = append(src.entries, entry.Name())
+			}
+		}
+		sort.Strings(src.entries)
+		src.allEntries = src.entries
+		src.dirPath = fullPath
+	} else {
+		// アーカイブ（またはアーカイブ内のフォルダ）
+		ref, folder, err := splitArchivePath(decodedPath)
+		if err != nil {
+			respondArchiveError(c, err)
+			return nil, false
+		}
+		files, err := listArchiveFiles(ref)
+		if err != nil {
+			log.Printf("Failed to list archive pages: %v", err)
+			respondArchiveError(c, err)
+			return nil, false
+		}
+		prefix := ""
+		if folder != "" {
+			prefix = folder + "/"
+		}
+		for _, page := range sortedArchivePages(files) {
+			src.allEntries = append(src.allEntries, page.Path)
+			if strings.HasPrefix(page.Path, prefix) {
+				src.entries = append(src.entries, page.Path)
+			}
+		}
+		if folder != "" && len(src.entries) == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Folder not found in archive"})
+			return nil, false
+		}
+		src.ref = ref
+		src.folder = folder
+		if folder != "" {
+			src.archivePath = strings.TrimSuffix(decodedPath, "/"+folder)
+		}
+		src.isArchive = true
+	}
+
+	if len(src.entries) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No image found"})
+		return nil, false
+	}
+	return src, true
+}
+
+// 各ページの画像サイズ（キーはentriesの要素、失敗時はレスポンスを書き込んでfalse）
+func (s *pageSource) pageSizes(c *gin.Context) (map[string]image.Config, bool) {
+	if s.isArchive {
+		sizes, err := archivePageSizes(s.ref)
+		if err != nil {
+			respondArchiveError(c, err)
+			return nil, false
+		}
+		return sizes, true
+	}
+	sizes, err := directoryPageSizes(s.dirPath)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return sizes, true
+}
+
+// 各ページのプレースホルダー（キーはentriesの要素）と、生成中かどうか
+func (s *pageSource) placeholders() (map[string]string, bool) {
+	if s.isArchive {
+		return archivePlaceholders(s.ref)
+	}
+	return directoryPlaceholders(s.dirPath)
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/xml"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/gin-gonic/gin"
+)
+
+const comicInfoMaxSize = 1 << 20 // ComicInfo.xmlの最大サイズ
+
+// ComicInfo.xmlのページ種別
+const (
+	comicPageFrontCover = "FrontCover"
+	comicPageBackCover  = "BackCover"
+	comicPageDeleted    = "Deleted"
+)
+
+// 見開きで単独表示となる理由
+const (
+	pairReasonCover     = "cover"
+	pairReasonBackCover = "back_cover"
+	pairReasonSpread    = "spread"
+	pairReasonOffset    = "offset"
+	pairReasonUnpaired  = "unpaired"
+)
+
+// comicInfo ComicInfo.xmlのうちページ情報のみ
+type comicInfo struct {
+	Pages []comicInfoPage `xml:"Pages>Page"`
+}
+
+type comicInfoPage struct {
+	Image      int    `xml:"Image,attr"`
+	Type       string `xml:"Type,attr"`
+	DoublePage bool   `xml:"DoublePage,attr"`
+}
+
+// PagePair 見開き表示の1画面分（ページは読む順）
+type PagePair struct {
+	Pages  []int    `json:"pages"`
+	Paths  []string `json:"paths"`
+	Reason string   `json:"reason,omitempty"` // 単独表示の理由
+}
+
+// pairingPage ペアリング対象のページ
+type pairingPage struct {
+	Index      int
+	Path       string
+	Type       string // ComicInfo.xmlのページ種別
+	DoublePage bool   // ComicInfo.xmlのDoublePage、または横長画像
+}
+
+// 作品ごとの見開きオフセット（ファイルに永続化）
+var pageOffsetStore *JSONStore[int]
+
+// ComicInfo.xmlのキャッシュ（キーはアーカイブ・ディレクトリと更新日時）
+var comicInfoCache = newMetadataCache[*comicInfo]()
+
+// 見開きオフセット初期化
+func initPageOffsetStore() {
+	pageOffsetStore = newJSONStore[int](config.Pairing.OffsetsFile)
+	if err := pageOffsetStore.load(); err != nil && !os.IsNotExist(err) {
+		log.Printf("Warning: Could not load page offsets file: %v", err)
+	}
+	log.Printf("Page offset store initialized - entries: %d", pageOffsetStore.Len())
+}
+
+// ComicInfo.xmlを解析
+func parseComicInfo(data []byte) *comicInfo {
+	var info comicInfo
+	if err := xml.Unmarshal(data, &info); err != nil {
+		log.Printf("Failed to parse ComicInfo.xml: %v", err)
+		return nil
+	}
+	return &info
+}
+
+// キャッシュ済みのComicInfo.xmlを取得し、なければloadで読み込んで保存
+func cachedComicInfo(cacheKey string, load func() *comicInfo) *comicInfo {
+	if info, found := comicInfoCache.Get(cacheKey); found {
+		return info
+	}
+
+	info := load()
+	comicInfoCache.Set(cacheKey, info)
+	return info
+}
+
+// アーカイブ直下のComicInfo.xml（存在しない場合はnil）
+func archiveComicInfo(ref archiveRef) *comicInfo {
+	return cachedComicInfo(versionedCacheKey(ref.Key(), ref.DiskPath), func() *comicInfo {
+		data, err := extractEntryFromArchive(ref, "ComicInfo.xml", comicInfoMaxSize)
+		if err != nil {
+			return nil
+		}
+		return parseComicInfo(data)
+	})
+}
+
+// ディレクトリ内のComicInfo.xml（存在しない場合はnil）
+func directoryComicInfo(dirPath string) *comicInfo {
+	return cachedComicInfo(versionedCacheKey(dirPath, dirPath), func() *comicInfo {
+		data, err := os.ReadFile(filepath.Join(dirPath, "ComicInfo.xml"))
+		if err != nil {
+			return nil
+		}
+		return parseComicInfo(data)
+	})
+}
+
+// ComicInfo.xmlのページ情報をパスに対応付け（allPagesはComicInfoの番号順のページ一覧）
+func comicInfoPagesByPath(info *comicInfo, allPages []string) map[string]comicInfoPage {
+	pages := make(map[string]comicInfoPage)
+	if info == nil {
+		return pages
+	}
+	for _, page := range info.Pages {
+		if page.Image >= 0 && page.Image < len(allPages) {
+			pages[allPages[page.Image]] = page
+		}
+	}
+	return pages
+}
+
+// ページを見開きの組に分ける
+// offsetが正の場合は表紙の後の先頭offsetページを単独表示、負の場合は表紙を単独表示しない
+func pairPages(pages []pairingPage, offset int) []PagePair {
+	var pairs []PagePair
+	single := func(page pairingPage, reason string) {
+		pairs = append(pairs, PagePair{Pages: []int{page.Index}, Paths: []string{page.Path}, Reason: reason})
+	}
+
+	// ComicInfoに表紙の指定がなければ先頭ページを表紙とみなす
+	hasCoverInfo := false
+	for _, page := range pages {
+		if page.Type == comicPageFrontCover {
+			hasCoverInfo = true
+			break
+		}
+	}
+
+	var pending *pairingPage
+	flush := func(reason string) {
+		if pending != nil {
+			single(*pending, reason)
+			pending = nil
+		}
+	}
+
+	leadingSingles := offset
+	for i, page := range pages {
+		isCover := page.Type == comicPageFrontCover || (!hasCoverInfo && i == 0)
+		switch {
+		case isCover && offset >= 0:
+			flush(pairReasonUnpaired)
+			single(page, pairReasonCover)
+		case page.Type == comicPageBackCover:
+			flush(pairReasonUnpaired)
+			single(page, pairReasonBackCover)
+		case page.DoublePage:
+			// 見開き画像の前で組がずれないよう、前のページは単独で表示
+			flush(pairReasonUnpaired)
+			single(page, pairReasonSpread)
+		case leadingSingles > 0:
+			flush(pairReasonUnpaired)
+			single(page, pairReasonOffset)
+			leadingSingles--
+		case pending == nil:
+			p := page
+			pending = &p
+		default:
+			pairs = append(pairs, PagePair{
+				Pages: []int{pending.Index, page.Index},
+				Paths: []string{pending.Path, page.Path},
+			})
+			pending = nil
+		}
+	}
+	flush(pairReasonUnpaired)
+	return pairs
+}
+
+// 見開きペアリングAPI
+func listPagePairs(c *gin.Context) {
+	src, ok := loadPageSource(c)
+	if !ok {
+		return
+	}
+	decodedPath := src.path
+	paths := src.entries
+
+	sizes, ok := src.pageSizes(c)
+	if !ok {
+		return
+	}
+	var info *comicInfo
+	if src.isArchive {
+		info = archiveComicInfo(src.ref)
+	} else {
+		info = directoryComicInfo(src.dirPath)
+	}
+	infoPages := comicInfoPagesByPath(info, src.allEntries)
+
+	// 削除指定のページを除き、見開き画像を判定（番号はページ一覧での位置）
+	var pages []pairingPage
+	for i, pagePath := range paths {
+		infoPage := infoPages[pagePath]
+		if infoPage.Type == comicPageDeleted {
+			continue
+		}
+		pages = append(pages, pairingPage{
+			Index:      i,
+			Path:       pagePath,
+			Type:       infoPage.Type,
+			DoublePage: infoPage.DoublePage || isSpread(rotatedConfig(sizes[pagePath], pageRotationStore.Get(src.pageKey(pagePath)))),
+		})
+	}
+
+	offset := pageOffsetStore.Get(decodedPath)
+	pairs := pairPages(pages, offset)
+
+	c.JSON(http.StatusOK, gin.H{
+		"path":        decodedPath,
+		"direction":   readingDirection(c, decodedPath),
+		"offset":      offset,
+		"comic_info":  len(infoPages) > 0,
+		"total_pages": len(paths),
+		"pairs":       pairs,
+	})
+}
+
+// 見開きオフセット保存API
+// 存在するディレクトリ・アーカイブ（内のフォルダ）のみ保存する
+func setPageOffset(c *gin.Context) {
+	src, ok := loadPageSource(c)
+	if !ok {
+		return
+	}
+	decodedPath := src.path
+
+	var body struct {
+		Offset int `json:"offset"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body: " + err.Error()})
+		return
+	}
+
+	if err := pageOffsetStore.Set(decodedPath, body.Offset); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save page offset: " + err.Error()})
+		return
+	}
+
+	log.Printf("Page offset for %s set to %d", decodedPath, body.Offset)
+	c.JSON(http.StatusOK, gin.H{
+		"path":   decodedPath,
+		"offset": body.Offset,
+	})
+}
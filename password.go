@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	errPasswordRequired  = errors.New("archive password required")
+	errPasswordIncorrect = errors.New("archive password incorrect")
+)
+
+// ArchivePassword アーカイブまたはディレクトリ単位のパスワード設定
+type ArchivePassword struct {
+	Path     string `yaml:"path" json:"path"`
+	Password string `yaml:"password" json:"password"`
+}
+
+// PasswordStore アーカイブパスワード管理
+type PasswordStore struct {
+	configured map[string]string // config.yaml由来
+	managed    map[string]string // 管理API由来（ファイルに永続化）
+	filename   string
+	mutex      sync.RWMutex
+}
+
+var passwordStore *PasswordStore
+
+// パスワード管理初期化
+func initPasswordStore() {
+	passwordStore = &PasswordStore{
+		configured: make(map[string]string),
+		managed:    make(map[string]string),
+		filename:   config.Archive.PasswordsFile,
+	}
+
+	for _, entry := range config.Archive.Passwords {
+		passwordStore.configured[normalizeLibraryPath(entry.Path)] = entry.Password
+	}
+
+	if err := passwordStore.load(); err != nil && !os.IsNotExist(err) {
+		log.Printf("Warning: Could not load passwords file: %v", err)
+	}
+	log.Printf("Password store initialized - configured: %d, managed: %d",
+		len(passwordStore.configured), len(passwordStore.managed))
+}
+
+// アーカイブ参照のソースパスからの相対パス
+func archiveRelPath(ref archiveRef) string {
+	rel, err := filepath.Rel(config.Manga.SourcePath, ref.DiskPath)
+	if err != nil {
+		rel = ref.DiskPath
+	}
+	parts := append([]string{filepath.ToSlash(rel)}, ref.Inner...)
+	return strings.Join(parts, "/")
+}
+
+// Lookup 最も長く一致するパスのパスワードを取得（管理API由来を優先）
+func (ps *PasswordStore) Lookup(relPath string) string {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+
+	relPath = normalizeLibraryPath(relPath)
+	for _, source := range []map[string]string{ps.managed, ps.configured} {
+		bestLen := -1
+		password := ""
+		for path, pw := range source {
+			if path == "" || path == relPath || strings.HasPrefix(relPath, path+"/") {
+				if len(path) > bestLen {
+					bestLen = len(path)
+					password = pw
+				}
+			}
+		}
+		if bestLen >= 0 {
+			return password
+		}
+	}
+	return ""
+}
+
+// Set 管理APIからパスワードを登録
+func (ps *PasswordStore) Set(path, password string) error {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	ps.managed[normalizeLibraryPath(path)] = password
+	return ps.save()
+}
+
+// Delete 管理APIから登録したパスワードを削除
+func (ps *PasswordStore) Delete(path string) (bool, error) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	path = normalizeLibraryPath(path)
+	if _, exists := ps.managed[path]; !exists {
+		return false, nil
+	}
+	delete(ps.managed, path)
+	return true, ps.save()
+}
+
+// Paths 登録済みパス一覧（パスワード自体は返さない）
+func (ps *PasswordStore) Paths() []gin.H {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+
+	var entries []gin.H
+	for path := range ps.configured {
+		entries = append(entries, gin.H{"path": path, "source": "config"})
+	}
+	for path := range ps.managed {
+		entries = append(entries, gin.H{"path": path, "source": "api"})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i]["path"].(string) < entries[j]["path"].(string)
+	})
+	return entries
+}
+
+func (ps *PasswordStore) load() error {
+	if ps.filename == "" {
+		return nil
+	}
+	data, err := os.ReadFile(ps.filename)
+	if err != nil {
+		return err
+	}
+
+	var entries []ArchivePassword
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		ps.managed[normalizeLibraryPath(entry.Path)] = entry.Password
+	}
+	return nil
+}
+
+func (ps *PasswordStore) save() error {
+	if ps.filename == "" {
+		return nil
+	}
+
+	entries := make([]ArchivePassword, 0, len(ps.managed))
+	for path, password := range ps.managed {
+		entries = append(entries, ArchivePassword{Path: path, Password: password})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(ps.filename, data, 0600)
+}
+
+// アーカイブに対応するパスワードを取得
+func archivePassword(ref archiveRef) string {
+	return passwordStore.Lookup(archiveRelPath(ref))
+}
+
+// RARのエラーをパスワード関連エラーに分類
+func classifyRarError(ref archiveRef, err error) error {
+	if err == nil || err == io.EOF {
+		return err
+	}
+
+	encrypted := strings.Contains(err.Error(), "incorrect password")
+	if !encrypted {
+		encrypted = isRarEncrypted(ref)
+	}
+	if !encrypted {
+		return err
+	}
+	if archivePassword(ref) == "" {
+		return errPasswordRequired
+	}
+	return errPasswordIncorrect
+}
+
+// RAR(1.5-4.x形式)のヘッダーから暗号化の有無を判定
+func isRarEncrypted(ref archiveRef) bool {
+	var r io.Reader
+	if len(ref.Inner) == 0 {
+		file, err := os.Open(firstRarVolume(ref.DiskPath))
+		if err != nil {
+			return false
+		}
+		defer file.Close()
+		r = file
+	} else {
+		data, err := loadNestedArchive(ref)
+		if err != nil {
+			return false
+		}
+		r = bytes.NewReader(data)
+	}
+
+	const (
+		blockMain        = 0x73
+		blockFile        = 0x74
+		flagArcEncrypted = 0x0080
+		flagFileEncrypt  = 0x0004
+		flagLongBlock    = 0x8000
+	)
+
+	br := bufio.NewReader(r)
+	signature := make([]byte, 7)
+	if _, err := io.ReadFull(br, signature); err != nil || string(signature) != "Rar!\x1a\x07\x00" {
+		return false
+	}
+
+	// ファイルヘッダーが見つかるまでブロックを辿る
+	header := make([]byte, 7)
+	for i := 0; i < 16; i++ {
+		if _, err := io.ReadFull(br, header); err != nil {
+			return false
+		}
+		blockType := header[2]
+		flags := binary.LittleEndian.Uint16(header[3:5])
+		size := int64(binary.LittleEndian.Uint16(header[5:7]))
+
+		switch blockType {
+		case blockMain:
+			if flags&flagArcEncrypted != 0 {
+				return true
+			}
+		case blockFile:
+			return flags&flagFileEncrypt != 0
+		}
+
+		skip := size - 7
+		if flags&flagLongBlock != 0 {
+			addSize := make([]byte, 4)
+			if _, err := io.ReadFull(br, addSize); err != nil {
+				return false
+			}
+			skip += int64(binary.LittleEndian.Uint32(addSize)) - 4
+		}
+		if skip < 0 {
+			return false
+		}
+		if _, err := br.Discard(int(skip)); err != nil {
+			return false
+		}
+	}
+	return false
+}
+
+// 管理API認証ミドルウェア
+func adminAuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if config.Admin.Token == "" {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Admin API is disabled"})
+			return
+		}
+
+		token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(config.Admin.Token)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid admin token"})
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// パスワード登録済みパス一覧API
+func listArchivePasswords(c *gin.Context) {
+	entries := passwordStore.Paths()
+	c.JSON(http.StatusOK, gin.H{
+		"passwords": entries,
+		"count":     len(entries),
+	})
+}
+
+// パスワード登録API
+func setArchivePassword(c *gin.Context) {
+	var entry ArchivePassword
+	if err := c.ShouldBindJSON(&entry); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body: " + err.Error()})
+		return
+	}
+	if entry.Password == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Password is required"})
+		return
+	}
+
+	if err := passwordStore.Set(entry.Path, entry.Password); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save password: " + err.Error()})
+		return
+	}
+
+	log.Printf("Archive password registered for: %s", normalizeLibraryPath(entry.Path))
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Password registered",
+		"path":    normalizeLibraryPath(entry.Path),
+	})
+}
+
+// パスワード削除API
+func deleteArchivePassword(c *gin.Context) {
+	requestPath := c.Param("path")
+
+	// URLデコード処理
+	decodedPath, err := url.QueryUnescape(requestPath)
+	if err != nil {
+		decodedPath = requestPath
+	}
+
+	deleted, err := passwordStore.Delete(decodedPath)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save password: " + err.Error()})
+		return
+	}
+	if !deleted {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No password registered for this path"})
+		return
+	}
+
+	log.Printf("Archive password removed for: %s", normalizeLibraryPath(decodedPath))
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Password removed",
+		"path":    normalizeLibraryPath(decodedPath),
+	})
+}
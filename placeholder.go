@@ -0,0 +1,353 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/disintegration/imaging"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	placeholderComponentsX = 4  // BlurHashの横方向の成分数
+	placeholderComponentsY = 3  // BlurHashの縦方向の成分数
+	placeholderSampleWidth = 32 // BlurHash計算用の縮小幅
+)
+
+const blurHashCharacters = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// プレースホルダーのキャッシュ（キーはアーカイブ・ディレクトリと更新日時、値はパスごとのBlurHash）
+var placeholderCache = newMetadataCache[map[string]string]()
+
+// placeholderJob バックグラウンドで生成中のプレースホルダー（完了するとplaceholderCacheに移る）
+type placeholderJob struct {
+	placeholders map[string]string
+	mutex        sync.Mutex
+}
+
+var placeholderJobs = make(map[string]*placeholderJob)
+var placeholderJobsMutex sync.Mutex
+
+func (job *placeholderJob) add(name, hash string) {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+	job.placeholders[name] = hash
+}
+
+// 生成済みの分の複製
+func (job *placeholderJob) snapshot() map[string]string {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+	placeholders := make(map[string]string, len(job.placeholders))
+	for name, hash := range job.placeholders {
+		placeholders[name] = hash
+	}
+	return placeholders
+}
+
+// 画像データからBlurHashを生成（デコードできない場合は空）
+// rotationはページごとの回転（他の変換結果と同じく回転後の画像から生成）
+func placeholderFromData(data []byte, item string, rotation int) string {
+	img, err := decodeImage(data, item)
+	if err != nil {
+		return ""
+	}
+	if rotation != 0 {
+		img = rotateImage(img, rotation)
+	}
+	return blurHash(img, placeholderComponentsX, placeholderComponentsY)
+}
+
+// BlurHashを生成（https://blurha.sh の形式）
+func blurHash(img image.Image, componentsX, componentsY int) string {
+	img = imaging.Resize(img, placeholderSampleWidth, 0, imaging.Box)
+	src := imaging.Clone(img)
+	width, height := src.Rect.Dx(), src.Rect.Dy()
+	if width == 0 || height == 0 {
+		return ""
+	}
+
+	// 画素をリニアRGBに変換
+	linear := make([][3]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			i := y*src.Stride + x*4
+			linear[y*width+x] = [3]float64{
+				srgbToLinear(src.Pix[i]), srgbToLinear(src.Pix[i+1]), srgbToLinear(src.Pix[i+2]),
+			}
+		}
+	}
+
+	factors := make([][3]float64, 0, componentsX*componentsY)
+	for j := 0; j < componentsY; j++ {
+		for i := 0; i < componentsX; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+			var factor [3]float64
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					basis := normalisation *
+						math.Cos(math.Pi*float64(i*x)/float64(width)) *
+						math.Cos(math.Pi*float64(j*y)/float64(height))
+					pixel := linear[y*width+x]
+					factor[0] += basis * pixel[0]
+					factor[1] += basis * pixel[1]
+					factor[2] += basis * pixel[2]
+				}
+			}
+			scale := 1 / float64(width*height)
+			factors = append(factors, [3]float64{factor[0] * scale, factor[1] * scale, factor[2] * scale})
+		}
+	}
+
+	var hash strings.Builder
+	hash.WriteString(encodeBase83((componentsX-1)+(componentsY-1)*9, 1))
+
+	// AC成分の最大値
+	maximumValue := 1.0
+	if len(factors) > 1 {
+		actualMaximum := 0.0
+		for _, factor := range factors[1:] {
+			for _, value := range factor {
+				actualMaximum = math.Max(actualMaximum, math.Abs(value))
+			}
+		}
+		quantisedMaximum := int(math.Max(0, math.Min(82, math.Floor(actualMaximum*166-0.5))))
+		maximumValue = float64(quantisedMaximum+1) / 166
+		hash.WriteString(encodeBase83(quantisedMaximum, 1))
+	} else {
+		hash.WriteString(encodeBase83(0, 1))
+	}
+
+	// DC成分（平均色）
+	dc := factors[0]
+	hash.WriteString(encodeBase83(linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4))
+
+	// AC成分
+	for _, factor := range factors[1:] {
+		quantise := func(value float64) int {
+			return int(math.Max(0, math.Min(18, math.Floor(signPow(value/maximumValue, 0.5)*9+9.5))))
+		}
+		hash.WriteString(encodeBase83(quantise(factor[0])*19*19+quantise(factor[1])*19+quantise(factor[2]), 2))
+	}
+	return hash.String()
+}
+
+func encodeBase83(value, length int) string {
+	result := make([]byte, length)
+	for i := 1; i <= length; i++ {
+		digit := (value / int(math.Pow(83, float64(length-i)))) % 83
+		result[i-1] = blurHashCharacters[digit]
+	}
+	return string(result)
+}
+
+func srgbToLinear(value uint8) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(value, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(value), exp), value)
+}
+
+// キャッシュ済みのプレースホルダーを取得
+// 生成済みでなければバックグラウンドでgenerateを開始し、生成できた分だけを返す（2番目の戻り値は生成中か）
+func cachedPlaceholders(cacheKey string, generate func(add func(name, hash string)) error) (map[string]string, bool) {
+	if placeholders, found := placeholderCache.Get(cacheKey); found {
+		return placeholders, false
+	}
+
+	placeholderJobsMutex.Lock()
+	defer placeholderJobsMutex.Unlock()
+	if placeholders, found := placeholderCache.Get(cacheKey); found {
+		return placeholders, false
+	}
+	job, running := placeholderJobs[cacheKey]
+	if !running {
+		job = &placeholderJob{placeholders: make(map[string]string)}
+		placeholderJobs[cacheKey] = job
+		go func() {
+			if err := generate(job.add); err != nil {
+				log.Printf("Failed to generate placeholders: %v", err)
+			} else {
+				placeholderCache.Set(cacheKey, job.snapshot())
+			}
+			placeholderJobsMutex.Lock()
+			delete(placeholderJobs, cacheKey)
+			placeholderJobsMutex.Unlock()
+		}()
+	}
+	return job.snapshot(), true
+}
+
+// プレースホルダーのキャッシュキー（ファイルの更新、ページの回転の変更で無効になる）
+func placeholderCacheKey(key, diskPath string) string {
+	return fmt.Sprintf("%s#rotations=%d", versionedCacheKey(key, diskPath), pageRotationStore.Version())
+}
+
+// アーカイブ内の各画像のプレースホルダー（キーはエントリパス）
+func archivePlaceholders(ref archiveRef) (map[string]string, bool) {
+	relPath := archiveRelPath(ref)
+	return cachedPlaceholders(placeholderCacheKey(ref.Key(), ref.DiskPath), func(add func(name, hash string)) error {
+		return forEachArchiveImage(ref, func(name string, data []byte) {
+			imageScheduler.Run(context.Background(), priorityBatch, func() {
+				rotation := pageRotationStore.Get(relPath + "/" + name)
+				if hash := placeholderFromData(data, ref.Key()+"/"+name, rotation); hash != "" {
+					add(name, hash)
+				}
+			})
+		})
+	})
+}
+
+// アーカイブ内の画像を先頭から順に読み込む（読み込めないエントリは飛ばす）
+func forEachArchiveImage(ref archiveRef, fn func(name string, data []byte)) error {
+	switch ref.Ext() {
+	case ".zip", ".cbz":
+		reader, closeReader, err := openZipArchive(ref)
+		if err != nil {
+			return err
+		}
+		defer closeReader()
+
+		password := archivePassword(ref)
+		for _, file := range reader.File {
+			if file.FileInfo().IsDir() || !isImageFile(strings.ToLower(filepath.Ext(file.Name))) {
+				continue
+			}
+			data, err := readZipEntryData(file, password)
+			if err != nil {
+				if isPasswordError(err) {
+					return err
+				}
+				if errors.Is(err, errEntryTooLarge) {
+					log.Printf("Image limit exceeded: %s/%s (%v)", ref.Key(), file.Name, errImageTooLarge)
+				}
+				continue
+			}
+			fn(file.Name, data)
+		}
+	case ".rar", ".cbr":
+		reader, closeReader, err := openRarArchive(ref)
+		if err != nil {
+			return err
+		}
+		defer closeReader()
+
+		for {
+			header, err := reader.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return classifyRarError(ref, err)
+			}
+			if header.IsDir || !isImageFile(strings.ToLower(filepath.Ext(header.Name))) {
+				continue
+			}
+			data, err := readEntryData(reader, maxImageBytes())
+			if err != nil {
+				if errors.Is(err, errEntryTooLarge) {
+					log.Printf("Image limit exceeded: %s/%s (%v)", ref.Key(), header.Name, errImageTooLarge)
+				}
+				continue
+			}
+			fn(header.Name, data)
+		}
+	default:
+		return errNotArchive
+	}
+	return nil
+}
+
+// ZIPエントリを読み込み（画像サイズの上限を超える場合は読み込まない）
+func readZipEntryData(file *zip.File, password string) ([]byte, error) {
+	limit := maxImageBytes()
+	if limit > 0 && file.UncompressedSize64 > uint64(limit) {
+		return nil, errEntryTooLarge
+	}
+	rc, err := openZipEntry(file, password)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return readEntryData(rc, limit)
+}
+
+// ディレクトリ内の各画像のプレースホルダー（キーはファイル名）
+func directoryPlaceholders(dirPath string) (map[string]string, bool) {
+	relDir, err := filepath.Rel(config.Manga.SourcePath, dirPath)
+	if err != nil {
+		relDir = dirPath
+	}
+	return cachedPlaceholders(placeholderCacheKey(dirPath, dirPath), func(add func(name, hash string)) error {
+		entries, err := os.ReadDir(dirPath)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			if entry.IsDir() || !isImageFile(strings.ToLower(filepath.Ext(entry.Name()))) {
+				continue
+			}
+			data, err := readImageFile(filepath.Join(dirPath, entry.Name()))
+			if err != nil {
+				continue
+			}
+			imageScheduler.Run(context.Background(), priorityBatch, func() {
+				rotation := pageRotationStore.Get(filepath.Join(relDir, entry.Name()))
+				if hash := placeholderFromData(data, filepath.Join(dirPath, entry.Name()), rotation); hash != "" {
+					add(entry.Name(), hash)
+				}
+			})
+		}
+		return nil
+	})
+}
+
+// placeholders=true が指定されているか
+func placeholdersRequested(c *gin.Context) bool {
+	requested, _ := strconv.ParseBool(c.Query("placeholders"))
+	return requested
+}
+
+// 生成中の場合は X-Placeholders-Pending ヘッダーで知らせる（クライアントは後で取得し直す）
+func setPlaceholdersPending(c *gin.Context, pending bool) {
+	if pending {
+		c.Header("X-Placeholders-Pending", "true")
+	}
+}
+
+// 一覧の各画像にプレースホルダーを設定（キーはアーカイブ内のパス、またはディレクトリ内のファイル名）
+func attachPlaceholders(files []FileInfo, placeholders map[string]string) {
+	for i := range files {
+		if !files[i].IsDir && !files[i].IsArchive {
+			files[i].Placeholder = placeholders[files[i].Path]
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+// 単色のテスト画像
+func solidTestImage(width, height int, c color.Color) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), &image.Uniform{C: c}, image.Point{}, draw.Src)
+	return img
+}
+
+// 期待値はリファレンス実装（https://github.com/woltapp/blurhash のC版encode.c）と同じ手順で同じ画像から計算した値
+// （TypeScript版はAC成分の最大値に絶対値を使わないため、負の成分が大きい画像では値が異なる）
+// 縮小の影響を受けないよう、幅はplaceholderSampleWidthと同じにする
+func TestBlurHashReference(t *testing.T) {
+	horizontal := image.NewNRGBA(image.Rect(0, 0, 32, 24))
+	gradient := image.NewNRGBA(image.Rect(0, 0, 32, 24))
+	for y := 0; y < 24; y++ {
+		for x := 0; x < 32; x++ {
+			v := uint8(x * 255 / 31)
+			horizontal.SetNRGBA(x, y, color.NRGBA{v, v, v, 255})
+			gradient.SetNRGBA(x, y, color.NRGBA{v, uint8(y * 255 / 23), 128, 255})
+		}
+	}
+
+	tests := []struct {
+		name       string
+		img        image.Image
+		componentX int
+		componentY int
+		want       string
+	}{
+		{"black", solidTestImage(32, 32, color.NRGBA{0, 0, 0, 255}), 4, 3, "L00000fQfQfQfQfQfQfQfQfQfQfQ"},
+		{"white", solidTestImage(32, 32, color.NRGBA{255, 255, 255, 255}), 4, 3, "L9TSUA~qfQ~q~qoffQoffQfQfQfQ"},
+		{"red", solidTestImage(32, 32, color.NRGBA{255, 0, 0, 255}), 4, 3, "L9TI:j|cfQ|c|co1fQo1fQfQfQfQ"},
+		{"white 1x1", solidTestImage(32, 32, color.NRGBA{255, 255, 255, 255}), 1, 1, "00TSUA"},
+		{"horizontal gradient", horizontal, 4, 3, "L$HetW00xuWBofWBj[fQfQfQfQfQ"},
+		{"gradient", gradient, 4, 3, "L$HewF2swxX8l}WDjte;gJfjfQfj"},
+	}
+	for _, tt := range tests {
+		if got := blurHash(tt.img, tt.componentX, tt.componentY); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// 縮小してから生成するため、同じ内容の大きな画像からも同じ値になること
+func TestBlurHashResized(t *testing.T) {
+	want := blurHash(solidTestImage(32, 48, color.NRGBA{255, 0, 0, 255}), 4, 3)
+	if got := blurHash(solidTestImage(320, 480, color.NRGBA{255, 0, 0, 255}), 4, 3); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestEncodeBase83(t *testing.T) {
+	tests := []struct {
+		value  int
+		length int
+		want   string
+	}{
+		{0, 1, "0"},
+		{21, 1, "L"},
+		{82, 1, "~"},
+		{3429, 2, "fQ"},
+		{0xffffff, 4, "TSUA"},
+		{0xff0000, 4, "TI:j"},
+	}
+	for _, tt := range tests {
+		if got := encodeBase83(tt.value, tt.length); got != tt.want {
+			t.Errorf("encodeBase83(%d, %d) = %q, want %q", tt.value, tt.length, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 組み込みの配信プロファイル名
+const (
+	profilePhone    = "phone"
+	profileTablet   = "tablet"
+	profileDesktop  = "desktop"
+	profileOriginal = "original"
+	profileEink     = "eink"
+)
+
+// クライアントに送信を求めるClient Hints
+const clientHintsHeaders = "Sec-CH-Width, Sec-CH-Viewport-Width, Sec-CH-DPR, Save-Data"
+
+// DeliveryProfile 配信プロファイル（0は無制限）
+type DeliveryProfile struct {
+	MaxWidth     int  `yaml:"max_width" json:"max_width"`
+	MaxHeight    int  `yaml:"max_height" json:"max_height"`
+	Quality      int  `yaml:"quality" json:"quality"`
+	KeepAnimated bool `yaml:"keep_animated" json:"keep_animated"` // アニメーションGIFはリサイズせずそのまま配信
+}
+
+// 未定義の組み込みプロファイルを補完（desktopはperformanceの既定値を使用）
+func ensureDefaultProfiles() {
+	if config.Performance.Profiles == nil {
+		config.Performance.Profiles = make(map[string]DeliveryProfile)
+	}
+
+	defaults := map[string]DeliveryProfile{
+		profilePhone:  {MaxWidth: 1080, MaxHeight: 1920, Quality: 80},
+		profileTablet: {MaxWidth: 1600, MaxHeight: 2560, Quality: 85},
+		profileDesktop: {
+			MaxWidth:     config.Performance.MaxImageWidth,
+			MaxHeight:    config.Performance.MaxImageHeight,
+			Quality:      config.Performance.ImageQuality,
+			KeepAnimated: true,
+		},
+		profileOriginal: {KeepAnimated: true},
+		profileEink:     {MaxWidth: 1404, MaxHeight: 1872},
+	}
+	for name, profile := range defaults {
+		if _, exists := config.Performance.Profiles[name]; !exists {
+			config.Performance.Profiles[name] = profile
+		}
+	}
+
+	if _, exists := config.Performance.Profiles[config.Performance.DefaultProfile]; !exists {
+		config.Performance.DefaultProfile = profileDesktop
+	}
+}
+
+// プロファイルのJPEG品質（未指定の場合はimage_quality）
+func (p DeliveryProfile) quality() int {
+	if p.Quality > 0 {
+		return p.Quality
+	}
+	return config.Performance.ImageQuality
+}
+
+// リクエストから配信プロファイルを選択（profile= クエリ > E-inkモード > Client Hints > 既定）
+func selectDeliveryProfile(c *gin.Context) (string, DeliveryProfile) {
+	profiles := config.Performance.Profiles
+
+	if name := strings.ToLower(c.Query("profile")); name != "" {
+		if profile, exists := profiles[name]; exists {
+			return name, profile
+		}
+	}
+
+	// E-inkモードは端末向けのプロファイルを使用
+	if einkRequested(c) {
+		if profile, exists := profiles[config.Eink.Profile]; exists {
+			return config.Eink.Profile, profile
+		}
+	}
+
+	// ヒントの有無でも結果が変わるため、ヒントがない場合もVaryを返す
+	c.Header("Vary", clientHintsHeaders)
+
+	name := config.Performance.DefaultProfile
+	if width := clientHintWidth(c); width > 0 {
+		name = profileForWidth(width)
+	} else if saveData(c) {
+		name = profileForWidth(1)
+	}
+
+	profile := profiles[name]
+	if saveData(c) && config.Performance.SaveDataQuality > 0 && profile.quality() > config.Performance.SaveDataQuality {
+		profile.Quality = config.Performance.SaveDataQuality
+	}
+	return name, profile
+}
+
+// Client Hintsから表示幅（物理ピクセル）を取得
+func clientHintWidth(c *gin.Context) int {
+	if width, err := strconv.Atoi(c.GetHeader("Sec-CH-Width")); err == nil && width > 0 {
+		return width
+	}
+
+	viewport := c.GetHeader("Sec-CH-Viewport-Width")
+	if viewport == "" {
+		viewport = c.GetHeader("Viewport-Width")
+	}
+	width, err := strconv.ParseFloat(viewport, 64)
+	if err != nil || width <= 0 {
+		return 0
+	}
+
+	dprHeader := c.GetHeader("Sec-CH-DPR")
+	if dprHeader == "" {
+		dprHeader = c.GetHeader("DPR")
+	}
+	if dpr, err := strconv.ParseFloat(dprHeader, 64); err == nil && dpr > 0 {
+		width *= dpr
+	}
+	return int(width + 0.5)
+}
+
+// Save-Data: on が指定されているか
+func saveData(c *gin.Context) bool {
+	return strings.EqualFold(strings.TrimSpace(c.GetHeader("Save-Data")), "on")
+}
+
+// 表示幅を満たす最小のプロファイルを選択（該当なしの場合は最大のもの）
+// einkはE-inkモード用の減色を前提としたサイズのため、表示幅からは選択しない
+func profileForWidth(width int) string {
+	var names []string
+	for name, profile := range config.Performance.Profiles {
+		if profile.MaxWidth > 0 && name != profileEink {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return config.Performance.DefaultProfile
+	}
+
+	profiles := config.Performance.Profiles
+	sort.Slice(names, func(i, j int) bool {
+		if profiles[names[i]].MaxWidth != profiles[names[j]].MaxWidth {
+			return profiles[names[i]].MaxWidth < profiles[names[j]].MaxWidth
+		}
+		return names[i] < names[j]
+	})
+	for _, name := range names {
+		if profiles[name].MaxWidth >= width {
+			return name
+		}
+	}
+	return names[len(names)-1]
+}
+
+// 画像ファイルのサイズをヘッダーのみ読み込んで取得（EXIFの向きを反映）
+func imageConfigFromFile(path string) image.Config {
+	file, err := os.Open(path)
+	if err != nil {
+		return image.Config{}
+	}
+	defer file.Close()
+
+	cfg, format, err := image.DecodeConfig(file)
+	if err != nil {
+		return image.Config{}
+	}
+	if format == "jpeg" {
+		if _, err := file.Seek(0, 0); err == nil {
+			cfg = orientedConfig(cfg, jpegOrientation(file))
+		}
+	}
+	return cfg
+}
+
+// 画像データのサイズをヘッダーのみ読み込んで取得（EXIFの向きを反映）
+func imageConfigFromData(data []byte) image.Config {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return image.Config{}
+	}
+	if format == "jpeg" {
+		cfg = orientedConfig(cfg, jpegOrientation(bytes.NewReader(data)))
+	}
+	return cfg
+}
+
+// 配信プロファイルを適用した変換オプションを生成
+// 2番目の戻り値は変換が必要かどうか（不要な場合は元画像をそのまま配信）
+// animatedはアニメーションGIFかどうか（プロファイルのkeep_animatedが有効ならそのまま配信）
+func profileImageOptions(c *gin.Context, relPath string, source image.Config, animated bool) (imageOptions, bool) {
+	name, profile := selectDeliveryProfile(c)
+	c.Header("X-Delivery-Profile", name)
+
+	width, _ := strconv.Atoi(c.DefaultQuery("width", "0"))
+	height, _ := strconv.Atoi(c.DefaultQuery("height", "0"))
+	quality := profile.quality()
+	if q, err := strconv.Atoi(c.Query("quality")); err == nil && q > 0 && q <= 100 {
+		quality = q
+	}
+
+	opts := newImageOptions(c, relPath, width, height, quality)
+	source = rotatedConfig(source, opts.Rotate)
+
+	// max_width= は元画像の幅を超える場合のみ縮小（拡大はしない）
+	if maxWidth, _ := strconv.Atoi(c.Query("max_width")); maxWidth > 0 && width <= 0 && source.Width > maxWidth {
+		width = maxWidth
+		opts.Width = maxWidth
+	}
+
+	if animated && profile.KeepAnimated && keepsAnimation(opts) && opts.Rotate == 0 {
+		return opts, false
+	}
+
+	// 縦長ページのスライスは幅のみを上限に合わせる（高さはスライス単位で扱う）
+	if opts.Slice >= 0 {
+		if opts.Width <= 0 || (profile.MaxWidth > 0 && opts.Width > profile.MaxWidth) {
+			opts.Width = profile.MaxWidth
+		}
+		if opts.Width >= source.Width {
+			opts.Width = 0
+		}
+		opts.Height = 0
+		return opts, true
+	}
+
+	if width > 0 || height > 0 {
+		// 明示的なサイズ指定もプロファイルの上限を超えない
+		if profile.MaxWidth > 0 && (opts.Width <= 0 || opts.Width > profile.MaxWidth) {
+			opts.Width = profile.MaxWidth
+		}
+		if profile.MaxHeight > 0 && (opts.Height <= 0 || opts.Height > profile.MaxHeight) {
+			opts.Height = profile.MaxHeight
+		}
+		return opts, true
+	}
+
+	// 元画像が上限を超える場合のみ縮小
+	exceeds := (profile.MaxWidth > 0 && source.Width > profile.MaxWidth) ||
+		(profile.MaxHeight > 0 && source.Height > profile.MaxHeight)
+	if exceeds {
+		opts.Width = profile.MaxWidth
+		opts.Height = profile.MaxHeight
+		return opts, true
+	}
+
+	// progressive= のみでは変換しない（JPEGはそのまま配信し、JPEG以外はJPEGで出力しないため効果がない）
+	return opts, opts.Crop || opts.Half != "" || opts.Enhance != "" || opts.Rotate != 0 || opts.Eink || (opts.Format != "" && opts.Format != formatPolicyKeep)
+}
+
+// 配信プロファイル一覧API
+func listDeliveryProfiles(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"profiles":        config.Performance.Profiles,
+		"default_profile": config.Performance.DefaultProfile,
+		"client_hints":    clientHintsHeaders,
+	})
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"image"
+	"io"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// プログレッシブJPEGエンコーダー（スペクトル選択のみ、4:2:0、ハフマン表はJPEG規格K.3の標準表）
+//
+// スキャン構成: DC（全成分）→ Y AC 1-5 → Cb AC 1-63 → Cr AC 1-63 → Y AC 6-63
+// 最初のスキャンでページ全体の低解像度版が表示され、以降のスキャンで精細になる。
+
+// ジグザグ順の位置から8x8ブロック内の位置への変換
+var jpegUnzigzag = [64]int{
+	0, 1, 8, 16, 9, 2, 3, 10,
+	17, 24, 32, 25, 18, 11, 4, 5,
+	12, 19, 26, 33, 40, 48, 41, 34,
+	27, 20, 13, 6, 7, 14, 21, 28,
+	35, 42, 49, 56, 57, 50, 43, 36,
+	29, 22, 15, 23, 30, 37, 44, 51,
+	58, 59, 52, 45, 38, 31, 39, 46,
+	53, 60, 61, 54, 47, 55, 62, 63,
+}
+
+// 量子化テーブルの基準値（ジグザグ順、JPEG規格K.1）
+var jpegBaseQuant = [2][64]int{
+	{
+		16, 11, 12, 14, 12, 10, 16, 14,
+		13, 14, 18, 17, 16, 19, 24, 40,
+		26, 24, 22, 22, 24, 49, 35, 37,
+		29, 40, 58, 51, 61, 60, 57, 51,
+		56, 55, 64, 72, 92, 78, 64, 68,
+		87, 69, 55, 56, 80, 109, 81, 87,
+		95, 98, 103, 104, 103, 62, 77, 113,
+		121, 112, 100, 120, 92, 101, 103, 99,
+	},
+	{
+		17, 18, 18, 24, 21, 24, 47, 26,
+		26, 47, 99, 66, 56, 66, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+	},
+}
+
+// jpegHuffmanSpec ハフマン表（符号長ごとの個数と値）
+type jpegHuffmanSpec struct {
+	counts [16]byte
+	values []byte
+}
+
+// 標準ハフマン表（輝度DC・輝度AC・色差DC・色差AC、JPEG規格K.3）
+var jpegHuffmanSpecs = [4]jpegHuffmanSpec{
+	{
+		[16]byte{0, 1, 5, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0},
+		[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	{
+		[16]byte{0, 2, 1, 3, 3, 2, 4, 3, 5, 5, 4, 4, 0, 0, 1, 125},
+		[]byte{
+			0x01, 0x02, 0x03, 0x00, 0x04, 0x11, 0x05, 0x12,
+			0x21, 0x31, 0x41, 0x06, 0x13, 0x51, 0x61, 0x07,
+			0x22, 0x71, 0x14, 0x32, 0x81, 0x91, 0xa1, 0x08,
+			0x23, 0x42, 0xb1, 0xc1, 0x15, 0x52, 0xd1, 0xf0,
+			0x24, 0x33, 0x62, 0x72, 0x82, 0x09, 0x0a, 0x16,
+			0x17, 0x18, 0x19, 0x1a, 0x25, 0x26, 0x27, 0x28,
+			0x29, 0x2a, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39,
+			0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48, 0x49,
+			0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59,
+			0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69,
+			0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79,
+			0x7a, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88, 0x89,
+			0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98,
+			0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7,
+			0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6,
+			0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3, 0xc4, 0xc5,
+			0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4,
+			0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda, 0xe1, 0xe2,
+			0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea,
+			0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+	{
+		[16]byte{0, 3, 1, 1, 1, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0},
+		[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	{
+		[16]byte{0, 2, 1, 2, 4, 4, 3, 4, 7, 5, 4, 4, 0, 1, 2, 119},
+		[]byte{
+			0x00, 0x01, 0x02, 0x03, 0x11, 0x04, 0x05, 0x21,
+			0x31, 0x06, 0x12, 0x41, 0x51, 0x07, 0x61, 0x71,
+			0x13, 0x22, 0x32, 0x81, 0x08, 0x14, 0x42, 0x91,
+			0xa1, 0xb1, 0xc1, 0x09, 0x23, 0x33, 0x52, 0xf0,
+			0x15, 0x62, 0x72, 0xd1, 0x0a, 0x16, 0x24, 0x34,
+			0xe1, 0x25, 0xf1, 0x17, 0x18, 0x19, 0x1a, 0x26,
+			0x27, 0x28, 0x29, 0x2a, 0x35, 0x36, 0x37, 0x38,
+			0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48,
+			0x49, 0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58,
+			0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68,
+			0x69, 0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78,
+			0x79, 0x7a, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87,
+			0x88, 0x89, 0x8a, 0x92, 0x93, 0x94, 0x95, 0x96,
+			0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5,
+			0xa6, 0xa7, 0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4,
+			0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3,
+			0xc4, 0xc5, 0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2,
+			0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda,
+			0xe2, 0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9,
+			0xea, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+}
+
+// jpegHuffmanCode 符号（上位8ビットが符号長、下位24ビットが符号）
+type jpegHuffmanCode []uint32
+
+var jpegHuffmanCodes [4]jpegHuffmanCode
+
+func init() {
+	for i, spec := range jpegHuffmanSpecs {
+		codes := make(jpegHuffmanCode, 256)
+		code, k := uint32(0), 0
+		for length, count := range spec.counts {
+			for j := byte(0); j < count; j++ {
+				codes[spec.values[k]] = uint32(length+1)<<24 | code
+				code++
+				k++
+			}
+			code <<= 1
+		}
+		jpegHuffmanCodes[i] = codes
+	}
+}
+
+// DCT係数の計算に使う余弦表
+var jpegCosTable = func() [8][8]float64 {
+	var table [8][8]float64
+	for x := 0; x < 8; x++ {
+		for u := 0; u < 8; u++ {
+			c := 1.0
+			if u == 0 {
+				c = 1 / math.Sqrt2
+			}
+			table[x][u] = c / 2 * math.Cos(float64(2*x+1)*float64(u)*math.Pi/16)
+		}
+	}
+	return table
+}()
+
+// jpegBitWriter エントロピー符号化データの書き込み（0xFFのバイトスタッフィング付き）
+type jpegBitWriter struct {
+	w     *bufio.Writer
+	bits  uint32
+	nBits uint32
+}
+
+func (bw *jpegBitWriter) emit(bits, nBits uint32) {
+	bits &= 1<<nBits - 1
+	bw.bits |= bits << (32 - bw.nBits - nBits)
+	bw.nBits += nBits
+	for bw.nBits >= 8 {
+		b := byte(bw.bits >> 24)
+		bw.w.WriteByte(b)
+		if b == 0xff {
+			bw.w.WriteByte(0x00)
+		}
+		bw.bits <<= 8
+		bw.nBits -= 8
+	}
+}
+
+func (bw *jpegBitWriter) emitHuffman(table int, value byte) {
+	code := jpegHuffmanCodes[table][value]
+	bw.emit(code&(1<<24-1), code>>24)
+}
+
+// 値を「カテゴリ（ビット数）+ 追加ビット」で書き込み
+func (bw *jpegBitWriter) emitValue(table int, run byte, value int32) {
+	magnitude := value
+	if magnitude < 0 {
+		magnitude = -magnitude
+		value--
+	}
+	size := uint32(0)
+	for magnitude > 0 {
+		size++
+		magnitude >>= 1
+	}
+	bw.emitHuffman(table, run<<4|byte(size))
+	if size > 0 {
+		bw.emit(uint32(value), size)
+	}
+}
+
+// スキャン終端の端数ビットを1で埋める
+func (bw *jpegBitWriter) flush() {
+	if bw.nBits > 0 {
+		bw.emit(0xff, 8-bw.nBits)
+	}
+	bw.bits, bw.nBits = 0, 0
+}
+
+// jpegComponent 成分ごとの量子化済みDCT係数（ジグザグ順）
+type jpegComponent struct {
+	blocks        [][64]int32
+	stride        int // ブロック単位の幅（MCU境界までの余白を含む）
+	width, height int // スキャンで符号化するブロック数
+	quant         int // 量子化テーブル番号
+}
+
+// プログレッシブJPEGでエンコード
+func encodeProgressiveJPEG(w io.Writer, img image.Image, quality int) error {
+	if quality < 1 {
+		quality = 1
+	} else if quality > 100 {
+		quality = 100
+	}
+	scale := 200 - quality*2
+	if quality < 50 {
+		scale = 5000 / quality
+	}
+	var quant [2][64]int
+	for t := range quant {
+		for i, base := range jpegBaseQuant[t] {
+			quant[t][i] = clampInt((base*scale+50)/100, 1, 255)
+		}
+	}
+
+	src := imaging.Clone(img)
+	width, height := src.Rect.Dx(), src.Rect.Dy()
+	if width == 0 || height == 0 {
+		return errors.New("cannot encode empty image")
+	}
+	mcuX, mcuY := (width+15)/16, (height+15)/16
+
+	// YCbCr平面（MCU境界まで端の画素を複製）
+	paddedW, paddedH := mcuX*16, mcuY*16
+	planes := [3][]float64{
+		make([]float64, paddedW*paddedH),
+		make([]float64, paddedW*paddedH/4),
+		make([]float64, paddedW*paddedH/4),
+	}
+	for y := 0; y < paddedH; y++ {
+		sy := y
+		if sy >= height {
+			sy = height - 1
+		}
+		for x := 0; x < paddedW; x++ {
+			sx := x
+			if sx >= width {
+				sx = width - 1
+			}
+			i := sy*src.Stride + sx*4
+			r, g, b := float64(src.Pix[i]), float64(src.Pix[i+1]), float64(src.Pix[i+2])
+			planes[0][y*paddedW+x] = 0.299*r + 0.587*g + 0.114*b
+			ci := (y/2)*(paddedW/2) + x/2
+			planes[1][ci] += (-0.168736*r - 0.331264*g + 0.5*b + 128) / 4
+			planes[2][ci] += (0.5*r - 0.418688*g - 0.081312*b + 128) / 4
+		}
+	}
+
+	chromaW, chromaH := (width+1)/2, (height+1)/2
+	components := [3]*jpegComponent{
+		newJPEGComponent(planes[0], paddedW, paddedH, (width+7)/8, (height+7)/8, quant[0], 0),
+		newJPEGComponent(planes[1], paddedW/2, paddedH/2, (chromaW+7)/8, (chromaH+7)/8, quant[1], 1),
+		newJPEGComponent(planes[2], paddedW/2, paddedH/2, (chromaW+7)/8, (chromaH+7)/8, quant[1], 1),
+	}
+
+	bw := &jpegBitWriter{w: bufio.NewWriter(w)}
+	out := bw.w
+
+	// SOI・DQT
+	out.Write([]byte{0xff, 0xd8})
+	out.Write([]byte{0xff, 0xdb, 0x00, 2 + 2*65})
+	for t := range quant {
+		out.WriteByte(byte(t))
+		for _, q := range quant[t] {
+			out.WriteByte(byte(q))
+		}
+	}
+
+	// SOF2（プログレッシブDCT）
+	out.Write([]byte{0xff, 0xc2, 0x00, 17, 8,
+		byte(height >> 8), byte(height), byte(width >> 8), byte(width), 3,
+		1, 0x22, 0, 2, 0x11, 1, 3, 0x11, 1})
+
+	// DHT
+	for i, spec := range jpegHuffmanSpecs {
+		class := byte(i%2) << 4
+		id := byte(i / 2)
+		length := 2 + 1 + 16 + len(spec.values)
+		out.Write([]byte{0xff, 0xc4, byte(length >> 8), byte(length), class | id})
+		out.Write(spec.counts[:])
+		out.Write(spec.values)
+	}
+
+	// DCスキャン（全成分をMCU単位で交互に符号化）
+	out.Write([]byte{0xff, 0xda, 0x00, 12, 3, 1, 0x00, 2, 0x11, 3, 0x11, 0, 0, 0})
+	var predictors [3]int32
+	for my := 0; my < mcuY; my++ {
+		for mx := 0; mx < mcuX; mx++ {
+			for i := 0; i < 4; i++ {
+				block := &components[0].blocks[(my*2+i/2)*components[0].stride+mx*2+i%2]
+				bw.emitValue(0, 0, block[0]-predictors[0])
+				predictors[0] = block[0]
+			}
+			for ci := 1; ci < 3; ci++ {
+				block := &components[ci].blocks[my*components[ci].stride+mx]
+				bw.emitValue(2, 0, block[0]-predictors[ci])
+				predictors[ci] = block[0]
+			}
+		}
+	}
+	bw.flush()
+
+	// ACスキャン（成分ごと）
+	scans := []struct{ component, start, end int }{
+		{0, 1, 5}, {1, 1, 63}, {2, 1, 63}, {0, 6, 63},
+	}
+	for _, scan := range scans {
+		component := components[scan.component]
+		table := 1 + component.quant*2
+		out.Write([]byte{0xff, 0xda, 0x00, 8, 1, byte(scan.component + 1), byte(component.quant),
+			byte(scan.start), byte(scan.end), 0})
+		for by := 0; by < component.height; by++ {
+			for bx := 0; bx < component.width; bx++ {
+				block := &component.blocks[by*component.stride+bx]
+				run := byte(0)
+				for k := scan.start; k <= scan.end; k++ {
+					if block[k] == 0 {
+						run++
+						continue
+					}
+					for run > 15 {
+						bw.emitHuffman(table, 0xf0)
+						run -= 16
+					}
+					bw.emitValue(table, run, block[k])
+					run = 0
+				}
+				if run > 0 {
+					bw.emitHuffman(table, 0x00) // EOB
+				}
+			}
+		}
+		bw.flush()
+	}
+
+	// EOI
+	out.Write([]byte{0xff, 0xd9})
+	return out.Flush()
+}
+
+// 平面をDCT変換・量子化してブロックに分割
+func newJPEGComponent(plane []float64, planeW, planeH, width, height int, quant [64]int, quantIndex int) *jpegComponent {
+	stride := planeW / 8
+	component := &jpegComponent{
+		blocks: make([][64]int32, stride*(planeH/8)),
+		stride: stride,
+		width:  width,
+		height: height,
+		quant:  quantIndex,
+	}
+
+	var rows [8][8]float64
+	for by := 0; by < planeH/8; by++ {
+		for bx := 0; bx < stride; bx++ {
+			// 行方向の1次元DCT
+			for y := 0; y < 8; y++ {
+				line := plane[(by*8+y)*planeW+bx*8:]
+				for u := 0; u < 8; u++ {
+					sum := 0.0
+					for x := 0; x < 8; x++ {
+						sum += (line[x] - 128) * jpegCosTable[x][u]
+					}
+					rows[y][u] = sum
+				}
+			}
+			// 列方向の1次元DCTと量子化
+			block := &component.blocks[by*stride+bx]
+			for k := 0; k < 64; k++ {
+				natural := jpegUnzigzag[k]
+				u, v := natural%8, natural/8
+				sum := 0.0
+				for y := 0; y < 8; y++ {
+					sum += rows[y][u] * jpegCosTable[y][v]
+				}
+				block[k] = int32(math.Round(sum / float64(quant[k])))
+			}
+		}
+	}
+	return component
+}
+
+func clampInt(value, min, max int) int {
+	if value < min {
+		return min
+	}
+	if value > max {
+		return max
+	}
+	return value
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+// グラデーションと縞模様を含むテスト画像
+func progressiveTestImage(width, height int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			v := uint8(0)
+			if (x/4+y/4)%2 == 0 {
+				v = 64
+			}
+			img.SetNRGBA(x, y, color.NRGBA{
+				R: uint8(x * 255 / max(width, 1)),
+				G: uint8(y * 255 / max(height, 1)),
+				B: 128 + v,
+				A: 255,
+			})
+		}
+	}
+	return img
+}
+
+// 各画素のRGBの差の平均
+func meanAbsDiff(a image.Image, b image.Image) float64 {
+	bounds := a.Bounds()
+	var total, count float64
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r1, g1, b1, _ := a.At(x, y).RGBA()
+			r2, g2, b2, _ := b.At(x, y).RGBA()
+			for _, d := range []int{int(r1>>8) - int(r2>>8), int(g1>>8) - int(g2>>8), int(b1>>8) - int(b2>>8)} {
+				if d < 0 {
+					d = -d
+				}
+				total += float64(d)
+				count++
+			}
+		}
+	}
+	return total / count
+}
+
+func TestEncodeProgressiveJPEGRoundTrip(t *testing.T) {
+	sizes := [][2]int{{1, 1}, {7, 13}, {8, 8}, {16, 16}, {17, 9}, {64, 64}, {300, 200}, {513, 257}}
+	qualities := []int{1, 30, 75, 95, 100}
+
+	for _, size := range sizes {
+		src := progressiveTestImage(size[0], size[1])
+		for _, quality := range qualities {
+			var buf bytes.Buffer
+			if err := encodeProgressiveJPEG(&buf, src, quality); err != nil {
+				t.Fatalf("%dx%d q%d: encode: %v", size[0], size[1], quality, err)
+			}
+			decoded, err := jpeg.Decode(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatalf("%dx%d q%d: decode: %v", size[0], size[1], quality, err)
+			}
+			if got := decoded.Bounds().Size(); got.X != size[0] || got.Y != size[1] {
+				t.Fatalf("%dx%d q%d: decoded size %dx%d", size[0], size[1], quality, got.X, got.Y)
+			}
+
+			// 同じ画質のベースラインJPEG（image/jpeg）と同程度の誤差であること
+			var baseline bytes.Buffer
+			if err := jpeg.Encode(&baseline, src, &jpeg.Options{Quality: quality}); err != nil {
+				t.Fatalf("%dx%d q%d: baseline encode: %v", size[0], size[1], quality, err)
+			}
+			reference, err := jpeg.Decode(&baseline)
+			if err != nil {
+				t.Fatalf("%dx%d q%d: baseline decode: %v", size[0], size[1], quality, err)
+			}
+			diff, limit := meanAbsDiff(src, decoded), meanAbsDiff(src, reference)+4
+			if diff > limit {
+				t.Errorf("%dx%d q%d: mean difference %.1f exceeds %.1f", size[0], size[1], quality, diff, limit)
+			}
+		}
+	}
+}
+
+func TestEncodeProgressiveJPEGGray(t *testing.T) {
+	src := image.NewGray(image.Rect(0, 0, 40, 30))
+	for i := range src.Pix {
+		src.Pix[i] = uint8(i * 7)
+	}
+	var buf bytes.Buffer
+	if err := encodeProgressiveJPEG(&buf, src, 85); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	decoded, err := jpeg.Decode(&buf)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if diff := meanAbsDiff(src, decoded); diff > 12 {
+		t.Errorf("mean difference %.1f exceeds 12", diff)
+	}
+}
+
+func TestEncodeProgressiveJPEGEmpty(t *testing.T) {
+	var buf bytes.Buffer
+	if err := encodeProgressiveJPEG(&buf, image.NewNRGBA(image.Rect(0, 0, 0, 0)), 80); err == nil {
+		t.Fatal("expected an error for an empty image")
+	}
+}
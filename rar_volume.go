@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	// 新形式: name.part1.rar, name.part02.rar ...
+	rarPartPattern = regexp.MustCompile(`(?i)^(.+)\.part(\d+)\.(rar|cbr)$`)
+	// 旧形式: name.rar, name.r00, name.r01 ...
+	rarOldVolumePattern = regexp.MustCompile(`(?i)^(.+)\.r(\d{2})$`)
+)
+
+// rarVolume 分割RARのボリューム情報
+type rarVolume struct {
+	First     bool  // 最初のボリュームかどうか
+	Count     int   // セット全体のボリューム数
+	TotalSize int64 // セット全体のサイズ
+}
+
+// rarVolumeSet 同じセットに属するボリュームの集計
+type rarVolumeSet struct {
+	first     string
+	firstNum  int
+	names     []string
+	totalSize int64
+}
+
+// ディレクトリエントリから分割RARのセットを検出（キーはエントリ名）
+func collectRarVolumes(entries []os.DirEntry) map[string]rarVolume {
+	sets := make(map[string]*rarVolumeSet)
+	mainRars := make(map[string]string) // 旧形式の親となる name.rar
+
+	addVolume := func(key, name string, number int, size int64) {
+		set, exists := sets[key]
+		if !exists {
+			set = &rarVolumeSet{firstNum: -1}
+			sets[key] = set
+		}
+		set.names = append(set.names, name)
+		set.totalSize += size
+		if set.firstNum < 0 || number < set.firstNum {
+			set.firstNum = number
+			set.first = name
+		}
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		name := entry.Name()
+
+		if m := rarPartPattern.FindStringSubmatch(name); m != nil {
+			number, _ := strconv.Atoi(m[2])
+			addVolume("part:"+strings.ToLower(m[1]+"."+m[3]), name, number, info.Size())
+			continue
+		}
+		if m := rarOldVolumePattern.FindStringSubmatch(name); m != nil {
+			number, _ := strconv.Atoi(m[2])
+			// .r00 は2番目のボリューム（1番目は name.rar）
+			addVolume("old:"+strings.ToLower(m[1]), name, number+1, info.Size())
+			continue
+		}
+		if strings.EqualFold(filepath.Ext(name), ".rar") {
+			base := strings.TrimSuffix(name, filepath.Ext(name))
+			mainRars[strings.ToLower(base)] = name
+			addVolume("old:"+strings.ToLower(base), name, 0, info.Size())
+		}
+	}
+
+	volumes := make(map[string]rarVolume)
+	for key, set := range sets {
+		// 単独のRARファイルは分割セットとして扱わない
+		if len(set.names) < 2 {
+			continue
+		}
+		// 旧形式は name.rar が存在する場合のみセットとみなす
+		if strings.HasPrefix(key, "old:") && mainRars[strings.TrimPrefix(key, "old:")] == "" {
+			continue
+		}
+		for _, name := range set.names {
+			volumes[name] = rarVolume{
+				First:     name == set.first,
+				Count:     len(set.names),
+				TotalSize: set.totalSize,
+			}
+		}
+	}
+	return volumes
+}
+
+// 分割RARの途中のボリュームが指定された場合は最初のボリュームに置き換える
+func firstRarVolume(path string) string {
+	dir, name := filepath.Split(path)
+	m := rarPartPattern.FindStringSubmatch(name)
+	if m == nil {
+		return path
+	}
+
+	number, _ := strconv.Atoi(m[2])
+	for first := 0; first <= 1 && first < number; first++ {
+		candidate := fmt.Sprintf("%s.part%0*d.%s", m[1], len(m[2]), first, m[3])
+		if _, err := os.Stat(filepath.Join(dir, candidate)); err == nil {
+			return filepath.Join(dir, candidate)
+		}
+	}
+	return path
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 画像処理の優先度（値が小さいほど優先）
+const (
+	priorityInteractive = iota // 表示中のページ
+	priorityPrefetch           // 先読み
+	priorityThumbnail          // サムネイル一覧
+	priorityBatch              // コンタクトシート・プレースホルダーなどの一括処理
+	priorityCount
+)
+
+var priorityNames = [priorityCount]string{"interactive", "prefetch", "thumbnail", "batch"}
+
+// ハンドラーが処理の優先度を設定するコンテキストキー
+const priorityContextKey = "image_priority"
+
+// ImageScheduler CPUを使う画像処理の実行数を制限し、優先度の高い処理から実行する
+type ImageScheduler struct {
+	mutex     sync.Mutex
+	workers   int
+	running   int
+	queues    [priorityCount][]chan struct{}
+	started   [priorityCount]int64
+	waitTotal [priorityCount]time.Duration
+}
+
+var imageScheduler *ImageScheduler
+
+// 既定の同時実行数
+// 画像のデコード・リサイズはimagingが内部で全CPUを使って並列化し、大きなページでは1件で数百MBを使うため、
+// 実行数はCPU数ではなく少数に抑え、残りは優先度順に待たせる
+const defaultSchedulerWorkers = 2
+
+// 画像処理スケジューラーの初期化（workersが0以下の場合は既定値）
+func initImageScheduler() {
+	workers := config.Scheduler.Workers
+	if workers <= 0 {
+		workers = defaultSchedulerWorkers
+	}
+	imageScheduler = &ImageScheduler{workers: workers}
+}
+
+// 実行枠を確保（空きがなければ優先度順に待つ）
+// ctxが終了した場合（時間の上限・クライアントの切断）は待つのをやめてエラーを返す
+func (s *ImageScheduler) Acquire(ctx context.Context, priority int) error {
+	start := time.Now()
+	s.mutex.Lock()
+	if s.running < s.workers {
+		s.running++
+		s.started[priority]++
+		s.mutex.Unlock()
+		return nil
+	}
+	ready := make(chan struct{})
+	s.queues[priority] = append(s.queues[priority], ready)
+	s.mutex.Unlock()
+
+	select {
+	case <-ready:
+	case <-ctx.Done():
+		s.mutex.Lock()
+		for i, waiting := range s.queues[priority] {
+			if waiting == ready {
+				s.queues[priority] = append(s.queues[priority][:i:i], s.queues[priority][i+1:]...)
+				s.mutex.Unlock()
+				return ctx.Err()
+			}
+		}
+		s.mutex.Unlock()
+		// キューから外す前に枠を引き渡された場合は次の処理に譲る
+		<-ready
+		s.Release()
+		return ctx.Err()
+	}
+
+	s.mutex.Lock()
+	s.started[priority]++
+	s.waitTotal[priority] += time.Since(start)
+	s.mutex.Unlock()
+	return nil
+}
+
+// 実行枠を解放（待っている処理があれば最も優先度の高いものに引き渡す）
+func (s *ImageScheduler) Release() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for priority := range s.queues {
+		if queue := s.queues[priority]; len(queue) > 0 {
+			s.queues[priority] = queue[1:]
+			close(queue[0])
+			return
+		}
+	}
+	s.running--
+}
+
+// 実行枠を確保して処理を実行（ctxが終了して枠を確保できなかった場合は実行せずにエラーを返す）
+func (s *ImageScheduler) Run(ctx context.Context, priority int, fn func()) error {
+	if err := s.Acquire(ctx, priority); err != nil {
+		return err
+	}
+	defer s.Release()
+	fn()
+	return nil
+}
+
+// 実行中・待機中の処理数
+func (s *ImageScheduler) Stats() gin.H {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	classes := gin.H{}
+	queued := 0
+	for priority, name := range priorityNames {
+		depth := len(s.queues[priority])
+		queued += depth
+		averageWait := 0.0
+		if s.started[priority] > 0 {
+			averageWait = float64(s.waitTotal[priority].Milliseconds()) / float64(s.started[priority])
+		}
+		classes[name] = gin.H{
+			"queued":          depth,
+			"started":         s.started[priority],
+			"average_wait_ms": averageWait,
+		}
+	}
+	return gin.H{
+		"workers": s.workers,
+		"running": s.running,
+		"queued":  queued,
+		"classes": classes,
+	}
+}
+
+// リクエストの処理優先度（ハンドラーの既定値、priority= クエリでは下げることのみ可能）
+func imagePriority(c *gin.Context) int {
+	priority := priorityInteractive
+	if value, exists := c.Get(priorityContextKey); exists {
+		priority = value.(int)
+	}
+	requested := strings.ToLower(c.Query("priority"))
+	for p, name := range priorityNames {
+		if name == requested && p > priority {
+			priority = p
+		}
+	}
+	return priority
+}
+
+// スケジューラーの状況
+func getSchedulerStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, imageScheduler.Stats())
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"image"
+	"net/http"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"github.com/gin-gonic/gin"
+)
+
+// 読み方向
+const (
+	directionRTL = "rtl" // 右綴じ（右ページから読む）
+	directionLTR = "ltr" // 左綴じ（左ページから読む）
+)
+
+// 見開きの半分
+const (
+	halfLeft  = "left"
+	halfRight = "right"
+)
+
+// VirtualPage 見開き分割を反映した仮想ページ
+type VirtualPage struct {
+	Index  int    `json:"index"`
+	Path   string `json:"path"`           // アーカイブ内のエントリパス、またはソースパスからの相対パス
+	Half   string `json:"half,omitempty"` // 見開きを分割した場合の左右
+	Spread bool   `json:"spread"`         // 見開き画像かどうか
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	URL    string `json:"url"`
+
+	Placeholder string `json:"placeholder,omitempty"` // 読み込み中に表示するBlurHash
+}
+
+// half= クエリを正規化（未対応の値は空）
+func normalizeHalf(half string) string {
+	switch strings.ToLower(half) {
+	case halfLeft:
+		return halfLeft
+	case halfRight:
+		return halfRight
+	}
+	return ""
+}
+
+// 読み方向を決定（direction= クエリ > ライブラリのdirection > 右綴じ）
+func readingDirection(c *gin.Context, relPath string) string {
+	direction := strings.ToLower(c.Query("direction"))
+	if direction == "" {
+		direction = strings.ToLower(libraryFor(relPath).Direction)
+	}
+	if direction == directionLTR {
+		return directionLTR
+	}
+	return directionRTL
+}
+
+// 画像サイズから見開きかどうかを判定
+func isSpread(cfg image.Config) bool {
+	if cfg.Width <= 0 || cfg.Height <= 0 {
+		return false
+	}
+	return float64(cfg.Width) > float64(cfg.Height)*config.Spread.MinAspectRatio
+}
+
+// 見開き画像の左右どちらかを切り出す
+func splitSpreadHalf(img image.Image, half string) image.Image {
+	bounds := img.Bounds()
+	middle := bounds.Min.X + bounds.Dx()/2
+	if half == halfLeft {
+		return imaging.Crop(img, image.Rect(bounds.Min.X, bounds.Min.Y, middle, bounds.Max.Y))
+	}
+	return imaging.Crop(img, image.Rect(middle, bounds.Min.Y, bounds.Max.X, bounds.Max.Y))
+}
+
+// 見開きを分割した仮想ページ一覧を生成（placeholdersはページのBlurHash、キーはentriesの要素）
+func buildVirtualPages(src *pageSource, sizes map[string]image.Config, placeholders map[string]string,
+	split bool, direction string) ([]VirtualPage, int) {
+	halves := []string{halfRight, halfLeft}
+	if direction == directionLTR {
+		halves = []string{halfLeft, halfRight}
+	}
+
+	var pages []VirtualPage
+	spreads := 0
+	for _, entry := range src.entries {
+		cfg := rotatedConfig(sizes[entry], pageRotationStore.Get(src.pageKey(entry)))
+		pagePath, pageURL := src.pagePath(entry), src.imageURL(entry)
+		spread := isSpread(cfg)
+		if spread {
+			spreads++
+		}
+
+		if !spread || !split {
+			pages = append(pages, VirtualPage{
+				Index:  len(pages),
+				Path:   pagePath,
+				Spread: spread,
+				Width:  cfg.Width,
+				Height: cfg.Height,
+				URL:    pageURL,
+
+				Placeholder: placeholders[entry],
+			})
+			continue
+		}
+
+		for _, half := range halves {
+			width := cfg.Width / 2
+			if half == halfRight {
+				width = cfg.Width - cfg.Width/2
+			}
+			pages = append(pages, VirtualPage{
+				Index:  len(pages),
+				Path:   pagePath,
+				Half:   half,
+				Spread: true,
+				Width:  width,
+				Height: cfg.Height,
+				URL:    pageURL + "?half=" + half,
+
+				Placeholder: placeholders[entry],
+			})
+		}
+	}
+	return pages, spreads
+}
+
+// 仮想ページ一覧API（ディレクトリ・アーカイブ・アーカイブ内フォルダに対応）
+func listVirtualPages(c *gin.Context) {
+	src, ok := loadPageSource(c)
+	if !ok {
+		return
+	}
+	decodedPath := src.path
+	split := c.DefaultQuery("split", "true") != "false"
+	direction := readingDirection(c, decodedPath)
+
+	sizes, ok := src.pageSizes(c)
+	if !ok {
+		return
+	}
+	var placeholders map[string]string
+	if placeholdersRequested(c) {
+		var pending bool
+		placeholders, pending = src.placeholders()
+		setPlaceholdersPending(c, pending)
+	}
+	pages, spreads := buildVirtualPages(src, sizes, placeholders, split, direction)
+
+	c.JSON(http.StatusOK, gin.H{
+		"path":        decodedPath,
+		"direction":   direction,
+		"split":       split,
+		"spreads":     spreads,
+		"total_pages": len(pages),
+		"pages":       pages,
+	})
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// variantCache リサイズ・変換済み画像のキャッシュ（元画像のキャッシュとは別管理）
+var variantCache *ImageCache
+
+// 変換済み画像のキャッシュ初期化
+func initVariantCache() {
+	variantCache = &ImageCache{
+		cache:   make(map[string]*CacheEntry),
+		maxSize: config.Cache.VariantMaxSize,
+		ttl:     time.Duration(config.Cache.TTLMinutes) * time.Minute,
+	}
+}
+
+// ディスク上のファイルの更新日時とサイズを含むキー（ファイルが更新されたら無効になる）
+func versionedCacheKey(key, diskPath string) string {
+	info, err := os.Stat(diskPath)
+	if err != nil {
+		return key
+	}
+	return fmt.Sprintf("%s@%d:%d", key, info.ModTime().UnixNano(), info.Size())
+}
+
+// 画像ファイルの識別子
+func fileSourceKey(imagePath string) string {
+	return versionedCacheKey(imagePath, imagePath)
+}
+
+// アーカイブ内の画像の識別子
+func archiveSourceKey(ref archiveRef, entry string) string {
+	return versionedCacheKey(ref.Key(), ref.DiskPath) + "!" + entry
+}
+
+// 変換結果のキャッシュキー（元画像の識別子と変換オプションから生成）
+// Acceptヘッダーは決定される出力形式としてのみ含める（ブラウザごとのヘッダーの違いでキャッシュ・ETagを分けない）
+// progressive= はJPEGで出力する場合のみ含める
+func variantCacheKey(sourceKey string, opts imageOptions, imageData []byte) string {
+	output := variantOutputFormat(opts, imageData)
+	progressive := opts.Progressive && strings.Contains(output, formatJPEG)
+	return generateCacheKey(sourceKey, fmt.Sprintf("variant:crop=%t:half=%s:slice=%d:enhance=%s:rotate=%d:eink=%t/%d/%t:w=%d:h=%d:q=%d:progressive=%t:out=%s",
+		opts.Crop, opts.Half, opts.Slice, opts.Enhance, opts.Rotate, opts.Eink, opts.Levels, opts.Dither, opts.Width, opts.Height, opts.Quality,
+		progressive, output))
+}
+
+// キャッシュの使用状況
+func imageCacheStats(ic *ImageCache) gin.H {
+	ic.mutex.RLock()
+	defer ic.mutex.RUnlock()
+
+	totalSize := int64(0)
+	expiredCount := 0
+	now := time.Now()
+	for _, entry := range ic.cache {
+		totalSize += int64(len(entry.Data))
+		if now.Sub(entry.Timestamp) > ic.ttl {
+			expiredCount++
+		}
+	}
+
+	return gin.H{
+		"cache_entries":      len(ic.cache),
+		"max_size":           ic.maxSize,
+		"total_memory_bytes": totalSize,
+		"total_memory_mb":    float64(totalSize) / 1024 / 1024,
+		"expired_entries":    expiredCount,
+	}
+}
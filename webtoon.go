@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/disintegration/imaging"
+	"github.com/gin-gonic/gin"
+)
+
+var errSliceNotFound = errors.New("slice not found")
+
+// StripSlice 縦スクロール表示用のスライス
+type StripSlice struct {
+	Page   int    `json:"page"`
+	Path   string `json:"path"`
+	Slice  int    `json:"slice"`
+	Slices int    `json:"slices"`
+	Y      int    `json:"y"` // ページ内での開始位置（元画像の座標）
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	URL    string `json:"url"`
+}
+
+// スライス番号（slice= クエリ、指定なしの場合は-1）
+func stripSliceIndex(c *gin.Context) int {
+	slice, err := strconv.Atoi(c.Query("slice"))
+	if err != nil || slice < 0 {
+		return -1
+	}
+	return slice
+}
+
+// 分割が必要な縦長ページか（高さがスライスの高さを超え、縦横比がwebtoonのmin_aspect_ratio以上）
+func isTallPage(cfg image.Config) bool {
+	sliceHeight := config.Webtoon.SliceHeight
+	if sliceHeight <= 0 || cfg.Width <= 0 || cfg.Height <= sliceHeight {
+		return false
+	}
+	return float64(cfg.Height) >= float64(cfg.Width)*config.Webtoon.MinAspectRatio
+}
+
+// ページを均等な高さのスライスに分割した範囲（縦長でないページは全体で1つ）
+func stripSlices(cfg image.Config) []image.Rectangle {
+	if !isTallPage(cfg) {
+		return []image.Rectangle{image.Rect(0, 0, cfg.Width, cfg.Height)}
+	}
+	count := (cfg.Height + config.Webtoon.SliceHeight - 1) / config.Webtoon.SliceHeight
+	slices := make([]image.Rectangle, count)
+	for i := range slices {
+		slices[i] = image.Rect(0, cfg.Height*i/count, cfg.Width, cfg.Height*(i+1)/count)
+	}
+	return slices
+}
+
+// デコード済みのページから全スライスを生成・キャッシュし、指定されたスライスを返す（スライス数を含む）
+func renderStripSlices(ctx context.Context, img image.Image, imageData []byte, item, sourceKey string, opts imageOptions) (renderedImage, error) {
+	bounds := img.Bounds()
+	slices := stripSlices(image.Config{Width: bounds.Dx(), Height: bounds.Dy()})
+	if opts.Slice >= len(slices) {
+		return renderedImage{slices: len(slices)}, errSliceNotFound
+	}
+
+	var requested renderedImage
+	for i, rect := range slices {
+		if err := checkRenderContext(ctx, item); err != nil {
+			return renderedImage{}, err
+		}
+		sliceOpts := opts
+		sliceOpts.Slice = i
+		sliceImg, format, vary := resizeAndConvert(imaging.Crop(img, rect.Add(bounds.Min)), imageData, sliceOpts)
+
+		var encoded bytes.Buffer
+		if err := encodeImage(&encoded, sliceImg, format, opts.Quality, opts.Progressive); err != nil {
+			return renderedImage{}, err
+		}
+		if err := checkRenderContext(ctx, item); err != nil {
+			return renderedImage{}, err
+		}
+		variantCache.Set(variantCacheKey(sourceKey, sliceOpts, imageData), encoded.Bytes())
+		if i == opts.Slice {
+			requested = renderedImage{data: encoded.Bytes(), format: format, vary: vary, slices: len(slices)}
+		}
+	}
+	return requested, nil
+}
+
+// 章全体を縦に連続したスライスの一覧として返す
+func listStripSlices(c *gin.Context) {
+	src, ok := loadPageSource(c)
+	if !ok {
+		return
+	}
+
+	var metas map[string]PageMeta
+	var err error
+	if src.isArchive {
+		if metas, err = archivePageMeta(src.ref); err != nil {
+			log.Printf("Failed to read page sizes: %v", err)
+			respondArchiveError(c, err)
+			return
+		}
+	} else if metas, err = directoryPageMeta(src.dirPath); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var strip []StripSlice
+	tallPages := 0
+	for page, entry := range src.entries {
+		cfg := rotatedConfig(metas[entry].Config(), pageRotationStore.Get(src.pageKey(entry)))
+		slices := stripSlices(cfg)
+		if len(slices) > 1 {
+			tallPages++
+		}
+		for i, rect := range slices {
+			pageURL := src.imageURL(entry)
+			if len(slices) > 1 {
+				pageURL += "?slice=" + strconv.Itoa(i)
+			}
+			strip = append(strip, StripSlice{
+				Page:   page,
+				Path:   src.pagePath(entry),
+				Slice:  i,
+				Slices: len(slices),
+				Y:      rect.Min.Y,
+				Width:  rect.Dx(),
+				Height: rect.Dy(),
+				URL:    pageURL,
+			})
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"path":         src.path,
+		"slice_height": config.Webtoon.SliceHeight,
+		"total_pages":  len(src.entries),
+		"tall_pages":   tallPages,
+		"total_slices": len(strip),
+		"slices":       strip,
+	})
+}
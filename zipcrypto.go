@@ -0,0 +1,296 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	zipFlagEncrypted      = 0x1
+	zipFlagDataDescriptor = 0x8
+	zipMethodWinZipAES    = 99
+	zipExtraWinZipAES     = 0x9901
+	zipCryptoHeaderLen    = 12
+	winZipAESVerifierLen  = 2
+	winZipAESAuthCodeLen  = 10
+)
+
+// 暗号化されたZIPエントリか判定
+func isZipEntryEncrypted(file *zip.File) bool {
+	return file.Flags&zipFlagEncrypted != 0
+}
+
+// ZIPエントリを開く（暗号化エントリはパスワードで復号）
+func openZipEntry(file *zip.File, password string) (io.ReadCloser, error) {
+	if !isZipEntryEncrypted(file) {
+		return file.Open()
+	}
+	if password == "" {
+		return nil, errPasswordRequired
+	}
+
+	raw, err := file.OpenRaw()
+	if err != nil {
+		return nil, err
+	}
+
+	if file.Method == zipMethodWinZipAES {
+		return openWinZipAESEntry(file, raw, password)
+	}
+	return openZipCryptoEntry(file, raw, password)
+}
+
+// ZIPエントリのパスワードを検証
+// AESはヘッダーの検証値のみ、ZipCryptoはヘッダーの検証が1バイトのみのため展開してCRCまで検証
+func checkZipPassword(file *zip.File, password string) error {
+	if !isZipEntryEncrypted(file) {
+		return nil
+	}
+	if password == "" {
+		return errPasswordRequired
+	}
+
+	raw, err := file.OpenRaw()
+	if err != nil {
+		return err
+	}
+
+	if file.Method == zipMethodWinZipAES {
+		params, err := parseWinZipAESExtra(file.Extra)
+		if err != nil {
+			return err
+		}
+		salt := make([]byte, params.saltLen()+winZipAESVerifierLen)
+		if _, err := io.ReadFull(raw, salt); err != nil {
+			return err
+		}
+		_, _, verifier := deriveWinZipAESKeys(password, salt[:params.saltLen()], params.keyLen())
+		if !bytes.Equal(verifier, salt[params.saltLen():]) {
+			return errPasswordIncorrect
+		}
+		return nil
+	}
+
+	rc, err := openZipCryptoEntry(file, raw, password)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	_, err = io.Copy(io.Discard, rc)
+	return err
+}
+
+// 従来型ZIP暗号（ZipCrypto）のキー
+type zipCryptoKeys [3]uint32
+
+func newZipCryptoKeys(password string) *zipCryptoKeys {
+	keys := &zipCryptoKeys{0x12345678, 0x23456789, 0x34567890}
+	for i := 0; i < len(password); i++ {
+		keys.update(password[i])
+	}
+	return keys
+}
+
+func (k *zipCryptoKeys) update(b byte) {
+	k[0] = crc32.IEEETable[byte(k[0])^b] ^ (k[0] >> 8)
+	k[1] = (k[1]+(k[0]&0xff))*134775813 + 1
+	k[2] = crc32.IEEETable[byte(k[2])^byte(k[1]>>24)] ^ (k[2] >> 8)
+}
+
+func (k *zipCryptoKeys) decrypt(b byte) byte {
+	t := k[2] | 2
+	plain := b ^ byte((t*(t^1))>>8)
+	k.update(plain)
+	return plain
+}
+
+// zipCryptoReader ZipCrypto復号リーダー
+type zipCryptoReader struct {
+	r    io.Reader
+	keys *zipCryptoKeys
+}
+
+func (z *zipCryptoReader) Read(p []byte) (int, error) {
+	n, err := z.r.Read(p)
+	for i := 0; i < n; i++ {
+		p[i] = z.keys.decrypt(p[i])
+	}
+	return n, err
+}
+
+// ZipCryptoヘッダーを復号してパスワードを検証
+func newZipCryptoReader(file *zip.File, raw io.Reader, password string) (*zipCryptoReader, error) {
+	header := make([]byte, zipCryptoHeaderLen)
+	if _, err := io.ReadFull(raw, header); err != nil {
+		return nil, err
+	}
+
+	keys := newZipCryptoKeys(password)
+	for i := range header {
+		header[i] = keys.decrypt(header[i])
+	}
+
+	// 最終バイトはCRC（データディスクリプタ使用時は更新時刻）の上位バイト
+	check := byte(file.CRC32 >> 24)
+	if file.Flags&zipFlagDataDescriptor != 0 {
+		check = byte(file.ModifiedTime >> 8)
+	}
+	if header[zipCryptoHeaderLen-1] != check {
+		return nil, errPasswordIncorrect
+	}
+
+	return &zipCryptoReader{r: raw, keys: keys}, nil
+}
+
+func openZipCryptoEntry(file *zip.File, raw io.Reader, password string) (io.ReadCloser, error) {
+	reader, err := newZipCryptoReader(file, raw, password)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := decompressZipEntry(file.Method, reader)
+	if err != nil {
+		return nil, err
+	}
+	return &zipCRCReader{rc: rc, hash: crc32.NewIEEE(), want: file.CRC32}, nil
+}
+
+// zipCRCReader 展開したデータのCRC32を末尾で検証するリーダー
+// ヘッダーの検証は誤ったパスワードでも1/256の確率で通過するため、CRCの不一致や展開の失敗はパスワード誤りとして扱う
+type zipCRCReader struct {
+	rc   io.ReadCloser
+	hash hash.Hash32
+	want uint32
+}
+
+func (z *zipCRCReader) Read(p []byte) (int, error) {
+	n, err := z.rc.Read(p)
+	z.hash.Write(p[:n])
+	if err == io.EOF && z.hash.Sum32() != z.want {
+		return n, errPasswordIncorrect
+	}
+	var corrupt flate.CorruptInputError
+	if errors.As(err, &corrupt) {
+		return n, errPasswordIncorrect
+	}
+	return n, err
+}
+
+func (z *zipCRCReader) Close() error {
+	return z.rc.Close()
+}
+
+// winZipAESParams WinZip AES拡張フィールドの内容
+type winZipAESParams struct {
+	strength byte
+	method   uint16
+}
+
+func (p winZipAESParams) keyLen() int {
+	return 8 + 8*int(p.strength)
+}
+
+func (p winZipAESParams) saltLen() int {
+	return 4 + 4*int(p.strength)
+}
+
+func parseWinZipAESExtra(extra []byte) (winZipAESParams, error) {
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra[0:2])
+		size := int(binary.LittleEndian.Uint16(extra[2:4]))
+		if len(extra) < 4+size {
+			break
+		}
+		if id == zipExtraWinZipAES && size >= 7 {
+			data := extra[4 : 4+size]
+			params := winZipAESParams{
+				strength: data[4],
+				method:   binary.LittleEndian.Uint16(data[5:7]),
+			}
+			if params.strength < 1 || params.strength > 3 {
+				return params, fmt.Errorf("unsupported AES strength: %d", params.strength)
+			}
+			return params, nil
+		}
+		extra = extra[4+size:]
+	}
+	return winZipAESParams{}, fmt.Errorf("missing WinZip AES extra field")
+}
+
+// PBKDF2で暗号化キー・認証キー・パスワード検証値を生成
+func deriveWinZipAESKeys(password string, salt []byte, keyLen int) ([]byte, []byte, []byte) {
+	derived := pbkdf2.Key([]byte(password), salt, 1000, 2*keyLen+winZipAESVerifierLen, sha1.New)
+	return derived[:keyLen], derived[keyLen : 2*keyLen], derived[2*keyLen:]
+}
+
+func openWinZipAESEntry(file *zip.File, raw io.Reader, password string) (io.ReadCloser, error) {
+	params, err := parseWinZipAESExtra(file.Extra)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := io.ReadAll(raw)
+	if err != nil {
+		return nil, err
+	}
+	saltLen := params.saltLen()
+	if len(data) < saltLen+winZipAESVerifierLen+winZipAESAuthCodeLen {
+		return nil, fmt.Errorf("corrupt AES encrypted entry: %s", file.Name)
+	}
+
+	salt := data[:saltLen]
+	verifier := data[saltLen : saltLen+winZipAESVerifierLen]
+	ciphertext := data[saltLen+winZipAESVerifierLen : len(data)-winZipAESAuthCodeLen]
+	authCode := data[len(data)-winZipAESAuthCodeLen:]
+
+	encKey, authKey, expected := deriveWinZipAESKeys(password, salt, params.keyLen())
+	if !bytes.Equal(verifier, expected) {
+		return nil, errPasswordIncorrect
+	}
+
+	mac := hmac.New(sha1.New, authKey)
+	mac.Write(ciphertext)
+	if !hmac.Equal(mac.Sum(nil)[:winZipAESAuthCodeLen], authCode) {
+		return nil, fmt.Errorf("AES authentication failed: %s", file.Name)
+	}
+
+	// WinZip AESはリトルエンディアンのカウンタ（1始まり）によるCTRモード
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, err
+	}
+	counter := make([]byte, aes.BlockSize)
+	keystream := make([]byte, aes.BlockSize)
+	for offset, n := 0, uint64(1); offset < len(ciphertext); offset, n = offset+aes.BlockSize, n+1 {
+		binary.LittleEndian.PutUint64(counter, n)
+		block.Encrypt(keystream, counter)
+		for i := 0; i < aes.BlockSize && offset+i < len(ciphertext); i++ {
+			ciphertext[offset+i] ^= keystream[i]
+		}
+	}
+
+	return decompressZipEntry(params.method, bytes.NewReader(ciphertext))
+}
+
+// 復号済みデータを展開（無圧縮とDeflateに対応）
+func decompressZipEntry(method uint16, r io.Reader) (io.ReadCloser, error) {
+	switch method {
+	case zip.Store:
+		return io.NopCloser(r), nil
+	case zip.Deflate:
+		return flate.NewReader(r), nil
+	default:
+		return nil, fmt.Errorf("unsupported compression method for encrypted entry: %d", method)
+	}
+}
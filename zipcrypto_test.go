@@ -0,0 +1,248 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"testing"
+)
+
+var zipTestContent = bytes.Repeat([]byte("manga-server encrypted page data "), 64)
+
+// テスト用に1エントリのZIPを作成して読み込む
+func testZipFile(t *testing.T, header *zip.FileHeader, data []byte) *zip.File {
+	t.Helper()
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	fw, err := w.CreateRaw(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r.File[0]
+}
+
+func deflateBytes(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	fw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(data)
+	fw.Close()
+	return buf.Bytes()
+}
+
+// ZipCryptoで暗号化したエントリを作成（ヘッダーの乱数部は固定値）
+func zipCryptoFile(t *testing.T, password string, method uint16) *zip.File {
+	t.Helper()
+	data := zipTestContent
+	if method == zip.Deflate {
+		data = deflateBytes(t, zipTestContent)
+	}
+	crc := crc32.ChecksumIEEE(zipTestContent)
+
+	plain := make([]byte, 0, zipCryptoHeaderLen+len(data))
+	for i := 0; i < zipCryptoHeaderLen-1; i++ {
+		plain = append(plain, byte(i*37+11))
+	}
+	plain = append(plain, byte(crc>>24))
+	plain = append(plain, data...)
+
+	keys := newZipCryptoKeys(password)
+	encrypted := make([]byte, len(plain))
+	for i, b := range plain {
+		k := keys[2] | 2
+		encrypted[i] = b ^ byte((k*(k^1))>>8)
+		keys.update(b)
+	}
+
+	return testZipFile(t, &zip.FileHeader{
+		Name:               "page.jpg",
+		Method:             method,
+		Flags:              zipFlagEncrypted,
+		CRC32:              crc,
+		CompressedSize64:   uint64(len(encrypted)),
+		UncompressedSize64: uint64(len(zipTestContent)),
+	}, encrypted)
+}
+
+// WinZip AES（AE-2、AES-256）で暗号化したエントリを作成
+func winZipAESFile(t *testing.T, password string, method uint16) *zip.File {
+	t.Helper()
+	data := zipTestContent
+	if method == zip.Deflate {
+		data = deflateBytes(t, zipTestContent)
+	}
+	params := winZipAESParams{strength: 3, method: method}
+
+	salt := make([]byte, params.saltLen())
+	for i := range salt {
+		salt[i] = byte(i*13 + 5)
+	}
+	encKey, authKey, verifier := deriveWinZipAESKeys(password, salt, params.keyLen())
+
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext := append([]byte(nil), data...)
+	counter := make([]byte, aes.BlockSize)
+	keystream := make([]byte, aes.BlockSize)
+	for offset, n := 0, uint64(1); offset < len(ciphertext); offset, n = offset+aes.BlockSize, n+1 {
+		binary.LittleEndian.PutUint64(counter, n)
+		block.Encrypt(keystream, counter)
+		for i := 0; i < aes.BlockSize && offset+i < len(ciphertext); i++ {
+			ciphertext[offset+i] ^= keystream[i]
+		}
+	}
+	mac := hmac.New(sha1.New, authKey)
+	mac.Write(ciphertext)
+
+	var entry []byte
+	entry = append(entry, salt...)
+	entry = append(entry, verifier...)
+	entry = append(entry, ciphertext...)
+	entry = append(entry, mac.Sum(nil)[:winZipAESAuthCodeLen]...)
+
+	extra := make([]byte, 11)
+	binary.LittleEndian.PutUint16(extra[0:2], zipExtraWinZipAES)
+	binary.LittleEndian.PutUint16(extra[2:4], 7)
+	binary.LittleEndian.PutUint16(extra[4:6], 2)
+	copy(extra[6:8], "AE")
+	extra[8] = params.strength
+	binary.LittleEndian.PutUint16(extra[9:11], method)
+
+	return testZipFile(t, &zip.FileHeader{
+		Name:               "page.jpg",
+		Method:             zipMethodWinZipAES,
+		Flags:              zipFlagEncrypted,
+		Extra:              extra,
+		CompressedSize64:   uint64(len(entry)),
+		UncompressedSize64: uint64(len(zipTestContent)),
+	}, entry)
+}
+
+func readZipEntry(file *zip.File, password string) ([]byte, error) {
+	rc, err := openZipEntry(file, password)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+func TestZipCryptoEntry(t *testing.T) {
+	for _, method := range []uint16{zip.Store, zip.Deflate} {
+		file := zipCryptoFile(t, "secret", method)
+
+		data, err := readZipEntry(file, "secret")
+		if err != nil {
+			t.Fatalf("method %d: %v", method, err)
+		}
+		if !bytes.Equal(data, zipTestContent) {
+			t.Fatalf("method %d: decrypted content does not match", method)
+		}
+		if err := checkZipPassword(file, "secret"); err != nil {
+			t.Fatalf("method %d: checkZipPassword: %v", method, err)
+		}
+
+		if _, err := readZipEntry(file, ""); !errors.Is(err, errPasswordRequired) {
+			t.Errorf("method %d: empty password: got %v, want errPasswordRequired", method, err)
+		}
+		if _, err := readZipEntry(file, "wrong"); !errors.Is(err, errPasswordIncorrect) {
+			t.Errorf("method %d: wrong password: got %v, want errPasswordIncorrect", method, err)
+		}
+	}
+}
+
+// ヘッダーの1バイト検証を通過する誤ったパスワードもCRCで検出できること
+func TestZipCryptoHeaderCollision(t *testing.T) {
+	for _, method := range []uint16{zip.Store, zip.Deflate} {
+		file := zipCryptoFile(t, "secret", method)
+
+		var collision string
+		for i := 0; i < 10000 && collision == ""; i++ {
+			candidate := fmt.Sprintf("wrong%d", i)
+			raw, err := file.OpenRaw()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := newZipCryptoReader(file, raw, candidate); err == nil {
+				collision = candidate
+			}
+		}
+		if collision == "" {
+			t.Fatalf("method %d: no password passing the header check was found", method)
+		}
+
+		if _, err := readZipEntry(file, collision); !errors.Is(err, errPasswordIncorrect) {
+			t.Errorf("method %d: %q: got %v, want errPasswordIncorrect", method, collision, err)
+		}
+		if err := checkZipPassword(file, collision); !errors.Is(err, errPasswordIncorrect) {
+			t.Errorf("method %d: checkZipPassword %q: got %v, want errPasswordIncorrect", method, collision, err)
+		}
+	}
+}
+
+func TestWinZipAESEntry(t *testing.T) {
+	for _, method := range []uint16{zip.Store, zip.Deflate} {
+		file := winZipAESFile(t, "secret", method)
+
+		data, err := readZipEntry(file, "secret")
+		if err != nil {
+			t.Fatalf("method %d: %v", method, err)
+		}
+		if !bytes.Equal(data, zipTestContent) {
+			t.Fatalf("method %d: decrypted content does not match", method)
+		}
+		if err := checkZipPassword(file, "secret"); err != nil {
+			t.Fatalf("method %d: checkZipPassword: %v", method, err)
+		}
+
+		if _, err := readZipEntry(file, "wrong"); !errors.Is(err, errPasswordIncorrect) {
+			t.Errorf("method %d: wrong password: got %v, want errPasswordIncorrect", method, err)
+		}
+		if err := checkZipPassword(file, "wrong"); !errors.Is(err, errPasswordIncorrect) {
+			t.Errorf("method %d: checkZipPassword wrong password: got %v, want errPasswordIncorrect", method, err)
+		}
+	}
+}
+
+// 認証コードが一致しない（改ざんされた）エントリは展開しないこと
+func TestWinZipAESAuthentication(t *testing.T) {
+	file := winZipAESFile(t, "secret", zip.Store)
+
+	raw, err := file.OpenRaw()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-winZipAESAuthCodeLen-1] ^= 0xff
+
+	tampered := testZipFile(t, &file.FileHeader, data)
+	if _, err := readZipEntry(tampered, "secret"); err == nil || errors.Is(err, errPasswordIncorrect) {
+		t.Errorf("got %v, want an authentication error", err)
+	}
+}
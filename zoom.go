@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/gin-gonic/gin"
+)
+
+// タイルのパス（{画像のパス}_files/{レベル}/{列}_{行}.jpg、Deep Zoom形式）
+var zoomTilePattern = regexp.MustCompile(`^(.+)_files/(\d+)/(\d+)_(\d+)\.(jpg|jpeg)$`)
+
+// ZoomLevel ズームレベルごとの画像サイズとタイル数
+type ZoomLevel struct {
+	Level   int `json:"level"`
+	Width   int `json:"width"`
+	Height  int `json:"height"`
+	Columns int `json:"columns"`
+	Rows    int `json:"rows"`
+}
+
+// デコード済みのレベル画像（同じ画像のタイルが続けて要求されるため少数を保持）
+type zoomImageEntry struct {
+	img      image.Image
+	pixels   int
+	lastUsed time.Time
+}
+
+var zoomImages = make(map[string]*zoomImageEntry)
+var zoomImageMutex sync.Mutex
+
+// Deep Zoomの最大レベル（レベル0が1x1、最大レベルが元画像のサイズ）
+func zoomMaxLevel(width, height int) int {
+	size := width
+	if height > size {
+		size = height
+	}
+	if size <= 1 {
+		return 0
+	}
+	return int(math.Ceil(math.Log2(float64(size))))
+}
+
+// レベルごとの画像サイズ
+func zoomLevelSize(width, height, level, maxLevel int) (int, int) {
+	scale := math.Pow(2, float64(maxLevel-level))
+	return int(math.Ceil(float64(width) / scale)), int(math.Ceil(float64(height) / scale))
+}
+
+func zoomTileSize() int {
+	if config.Zoom.TileSize > 0 {
+		return config.Zoom.TileSize
+	}
+	return 254
+}
+
+// タイルの範囲（隣接タイルとの重なりを含む）
+func zoomTileRect(levelWidth, levelHeight, column, row int) image.Rectangle {
+	tileSize, overlap := zoomTileSize(), config.Zoom.Overlap
+	x0, y0 := column*tileSize, row*tileSize
+	x1, y1 := x0+tileSize+overlap, y0+tileSize+overlap
+	if column > 0 {
+		x0 -= overlap
+	}
+	if row > 0 {
+		y0 -= overlap
+	}
+	if x1 > levelWidth {
+		x1 = levelWidth
+	}
+	if y1 > levelHeight {
+		y1 = levelHeight
+	}
+	return image.Rect(x0, y0, x1, y1)
+}
+
+// zoomSource ズーム対象のページ画像（ディレクトリ内の画像またはアーカイブ内の画像）
+type zoomSource struct {
+	filePath  string // ディレクトリ内の画像の場合のファイル
+	ref       archiveRef
+	imageName string // アーカイブ内の画像の場合のエントリ名
+	sourceKey string // 元画像の識別子
+	diskPath  string // Last-Modifiedに使うファイル
+}
+
+// ズーム対象のページ画像を特定（画像データは読み込まない）
+func resolveZoomSource(c *gin.Context, relPath string) (zoomSource, bool) {
+	fullPath := filepath.Join(config.Manga.SourcePath, relPath)
+	if info, err := os.Stat(fullPath); err == nil && !info.IsDir() {
+		if !isImageFile(strings.ToLower(filepath.Ext(fullPath))) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Not an image file"})
+			return zoomSource{}, false
+		}
+		return zoomSource{filePath: fullPath, sourceKey: fileSourceKey(fullPath), diskPath: fullPath}, true
+	}
+
+	ref, imageName, err := splitArchivePath(relPath)
+	if err != nil {
+		respondArchiveError(c, err)
+		return zoomSource{}, false
+	}
+	if imageName == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid path format"})
+		return zoomSource{}, false
+	}
+	return zoomSource{ref: ref, imageName: imageName, sourceKey: archiveSourceKey(ref, imageName), diskPath: ref.DiskPath}, true
+}
+
+// ページ画像のデータを読み込む
+func (src zoomSource) load(c *gin.Context) ([]byte, bool) {
+	if src.filePath != "" {
+		data, err := readImageFile(src.filePath)
+		if err != nil {
+			respondImageError(c, err)
+			return nil, false
+		}
+		return data, true
+	}
+
+	cacheKey := generateCacheKey(src.ref.Key(), src.imageName)
+	data, found := imageCache.Get(cacheKey)
+	if !found {
+		var err error
+		data, err = extractImageFromArchive(src.ref, src.imageName)
+		if err != nil {
+			log.Printf("Failed to extract image from archive: %v", err)
+			if isPasswordError(err) || isImageLimitError(err) {
+				respondArchiveError(c, err)
+				return nil, false
+			}
+			c.JSON(http.StatusNotFound, gin.H{"error": "Image not found in archive"})
+			return nil, false
+		}
+		imageCache.Set(cacheKey, data)
+	}
+	return data, true
+}
+
+// Deep Zoomの画像情報またはタイルを配信
+func serveZoom(c *gin.Context) {
+	requestPath := c.Param("path")
+
+	// URLデコード処理
+	decodedPath, err := url.QueryUnescape(requestPath)
+	if err != nil {
+		decodedPath = requestPath
+	}
+
+	// 先頭のスラッシュを削除
+	decodedPath = strings.Trim(decodedPath, "/")
+
+	if match := zoomTilePattern.FindStringSubmatch(decodedPath); match != nil {
+		level, _ := strconv.Atoi(match[2])
+		column, _ := strconv.Atoi(match[3])
+		row, _ := strconv.Atoi(match[4])
+		serveZoomTile(c, match[1], level, column, row)
+		return
+	}
+
+	src, ok := resolveZoomSource(c, decodedPath)
+	if !ok {
+		return
+	}
+	data, ok := src.load(c)
+	if !ok {
+		return
+	}
+	cfg := rotatedConfig(imageConfigFromData(data), pageRotationStore.Get(decodedPath))
+	if cfg.Width <= 0 || cfg.Height <= 0 {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Unsupported image format"})
+		return
+	}
+
+	maxLevel := zoomMaxLevel(cfg.Width, cfg.Height)
+	tileSize := zoomTileSize()
+	levels := make([]ZoomLevel, 0, maxLevel+1)
+	for level := 0; level <= maxLevel; level++ {
+		width, height := zoomLevelSize(cfg.Width, cfg.Height, level, maxLevel)
+		levels = append(levels, ZoomLevel{
+			Level:   level,
+			Width:   width,
+			Height:  height,
+			Columns: (width + tileSize - 1) / tileSize,
+			Rows:    (height + tileSize - 1) / tileSize,
+		})
+	}
+
+	// OpenSeadragonなどが読み込めるDeep Zoom（DZI）のJSON形式
+	c.JSON(http.StatusOK, gin.H{
+		"Image": gin.H{
+			"xmlns":    "http://schemas.microsoft.com/deepzoom/2008",
+			"Url":      "/api/v1/zoom/" + url.QueryEscape(decodedPath) + "_files/",
+			"Format":   "jpg",
+			"Overlap":  strconv.Itoa(config.Zoom.Overlap),
+			"TileSize": strconv.Itoa(tileSize),
+			"Size": gin.H{
+				"Width":  strconv.Itoa(cfg.Width),
+				"Height": strconv.Itoa(cfg.Height),
+			},
+		},
+		"path":      decodedPath,
+		"max_level": maxLevel,
+		"levels":    levels,
+	})
+}
+
+func serveZoomTile(c *gin.Context, relPath string, level, column, row int) {
+	src, ok := resolveZoomSource(c, relPath)
+	if !ok {
+		return
+	}
+
+	// ページごとの回転はレベル画像・タイルのキャッシュキーにも含める
+	rotation := pageRotationStore.Get(relPath)
+	sourceKey := fmt.Sprintf("%s:rotate=%d", src.sourceKey, rotation)
+
+	// 304・生成済みのタイルは画像を読み込まずに返す
+	tileKey := generateCacheKey(sourceKey, fmt.Sprintf("zoom:%d:%d:q=%d:%d/%d_%d",
+		zoomTileSize(), config.Zoom.Overlap, config.Zoom.Quality, level, column, row))
+	validator := newImageValidator(tileKey, src.diskPath)
+	if respondNotModified(c, validator) {
+		return
+	}
+	if cached, found := variantCache.Get(tileKey); found {
+		setEncodedImageHeaders(c, formatJPEG, false)
+		serveImageContent(c, imageFormatContentType(formatJPEG), cached, validator)
+		return
+	}
+
+	data, ok := src.load(c)
+	if !ok {
+		return
+	}
+	cfg := rotatedConfig(imageConfigFromData(data), rotation)
+	maxLevel := zoomMaxLevel(cfg.Width, cfg.Height)
+	if cfg.Width <= 0 || level > maxLevel {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tile not found"})
+		return
+	}
+	levelWidth, levelHeight := zoomLevelSize(cfg.Width, cfg.Height, level, maxLevel)
+	rect := zoomTileRect(levelWidth, levelHeight, column, row)
+	if rect.Empty() || rect.Min.X >= levelWidth || rect.Min.Y >= levelHeight {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tile not found"})
+		return
+	}
+
+	rendered, err := renderWithTimeout(c, relPath, func(ctx context.Context) (renderedImage, error) {
+		levelImg, err := zoomLevelImage(ctx, data, relPath, sourceKey, rotation, level, maxLevel, levelWidth, levelHeight)
+		if err != nil {
+			return renderedImage{}, err
+		}
+
+		var encoded bytes.Buffer
+		tile := imaging.Crop(levelImg, rect.Add(levelImg.Bounds().Min))
+		if err := encodeImage(&encoded, tile, formatJPEG, config.Zoom.Quality, false); err != nil {
+			return renderedImage{}, err
+		}
+		if err := checkRenderContext(ctx, relPath); err != nil {
+			return renderedImage{}, err
+		}
+		variantCache.Set(tileKey, encoded.Bytes())
+		return renderedImage{data: encoded.Bytes(), format: formatJPEG}, nil
+	})
+	if err != nil {
+		respondImageError(c, err)
+		return
+	}
+	setEncodedImageHeaders(c, rendered.format, false)
+	serveImageContent(c, imageFormatContentType(rendered.format), rendered.data, validator)
+}
+
+// 指定レベルのサイズに縮小した画像（保持している最も近い上位レベルから縮小）
+// デコードの後にctxを確認し、時間の上限を超えた場合は縮小せずに中断する
+func zoomLevelImage(ctx context.Context, data []byte, item, sourceKey string, rotation, level, maxLevel, width, height int) (image.Image, error) {
+	zoomImageMutex.Lock()
+	var source image.Image
+	for l := level; l <= maxLevel && source == nil; l++ {
+		if entry, found := zoomImages[fmt.Sprintf("%s#%d", sourceKey, l)]; found {
+			entry.lastUsed = time.Now()
+			source = entry.img
+		}
+	}
+	zoomImageMutex.Unlock()
+
+	if source == nil {
+		decoded, err := decodeImage(data, item)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkRenderContext(ctx, item); err != nil {
+			return nil, err
+		}
+		source = decoded
+		if rotation != 0 {
+			source = rotateImage(decoded, rotation)
+		}
+		storeZoomImage(fmt.Sprintf("%s#%d", sourceKey, maxLevel), source)
+	}
+
+	if bounds := source.Bounds(); bounds.Dx() == width && bounds.Dy() == height {
+		return source, nil
+	}
+	img := imaging.Resize(source, width, height, imaging.Linear)
+	storeZoomImage(fmt.Sprintf("%s#%d", sourceKey, level), img)
+	return img, nil
+}
+
+// 保持するレベル画像の数（zoom.cached_images、最低1）
+func zoomCachedImages() int {
+	return max(config.Zoom.CachedImages, 1)
+}
+
+// 保持するレベル画像の合計画素数（zoom.cached_megapixels、最低1メガピクセル）
+func zoomCachedPixels() int {
+	return max(config.Zoom.CachedMegapixels, 1) * 1000 * 1000
+}
+
+// レベル画像を保持（数・合計画素数の上限を超えたら最も古く使われたものを削除）
+// 追加した画像は上限を超えていても保持する（同じ画像のタイルが続けて要求されるため）
+func storeZoomImage(key string, img image.Image) {
+	zoomImageMutex.Lock()
+	defer zoomImageMutex.Unlock()
+
+	bounds := img.Bounds()
+	zoomImages[key] = &zoomImageEntry{img: img, pixels: bounds.Dx() * bounds.Dy(), lastUsed: time.Now()}
+	for len(zoomImages) > 1 && (len(zoomImages) > zoomCachedImages() || zoomImagePixels() > zoomCachedPixels()) {
+		oldestKey := ""
+		var oldest time.Time
+		for k, entry := range zoomImages {
+			if k != key && (oldestKey == "" || entry.lastUsed.Before(oldest)) {
+				oldestKey, oldest = k, entry.lastUsed
+			}
+		}
+		delete(zoomImages, oldestKey)
+	}
+}
+
+// 保持しているレベル画像の合計画素数（zoomImageMutexを保持して呼び出す）
+func zoomImagePixels() int {
+	total := 0
+	for _, entry := range zoomImages {
+		total += entry.pixels
+	}
+	return total
+}